@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CheckRecord 一次验证中单个协议的结果
+type CheckRecord struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"` // http、https、socks5 等, tcp 表示验证前的格式或连接检查
+	Success  bool      `json:"success"`
+	Latency  int64     `json:"latency"` // 总耗时(毫秒)
+	Error    string    `json:"error"`   // 错误分类, 成功时为空, 见 classifyError
+	Target   string    `json:"target"`  // 验证时访问的地址
+}
+
+// classifyError 将验证错误归类, 便于统计和排查
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	msg := err.Error()
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, errBadCert):
+		return "cert"
+	case errors.Is(err, errTampered):
+		return "tampered"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), strings.Contains(msg, "tls:"):
+		return "tls"
+	case strings.Contains(msg, "socks"):
+		return "socks"
+	case strings.Contains(msg, "status code"), strings.Contains(msg, "Proxy Authentication Required"):
+		return "status"
+	case errors.Is(err, errBodyMismatch):
+		return "content"
+	case errors.Is(err, errTooSlow):
+		return "slow"
+	}
+	return "other"
+}
+
+func (pdb *ProxyDB) createCheckTable() error {
+	_, err := pdb.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_checks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ip TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		protocol TEXT NOT NULL,
+		success INTEGER NOT NULL,
+		latency INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		target TEXT NOT NULL
+	)`, pdb.table))
+	if err != nil {
+		return err
+	}
+	_, err = pdb.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_checks_ip ON %s_checks (ip, time)", pdb.table, pdb.table))
+	return err
+}
+
+// AddChecks 保存一次验证的结果
+func (pdb *ProxyDB) AddChecks(ip string, checks []CheckRecord) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	tx, err := pdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s_checks (ip, time, protocol, success, latency, error, target) VALUES (?, ?, ?, ?, ?, ?, ?)", pdb.table))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, check := range checks {
+		_, err := stmt.Exec(ip, check.Time.Unix(), check.Protocol, check.Success, check.Latency, check.Error, check.Target)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetChecks 获取代理 since 之后的验证记录, 按时间从新到旧, 最多 limit 条
+func (pdb *ProxyDB) GetChecks(ip string, since time.Time, limit int) ([]CheckRecord, error) {
+	rows, err := pdb.db.Query(fmt.Sprintf("SELECT time, protocol, success, latency, error, target FROM %s_checks WHERE ip = ? AND time >= ? ORDER BY time DESC, id DESC LIMIT ?", pdb.table),
+		ip, since.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := []CheckRecord{}
+	for rows.Next() {
+		var check CheckRecord
+		var unix int64
+		if err := rows.Scan(&unix, &check.Protocol, &check.Success, &check.Latency, &check.Error, &check.Target); err != nil {
+			return nil, err
+		}
+		check.Time = time.Unix(unix, 0)
+		checks = append(checks, check)
+	}
+	return checks, rows.Err()
+}
+
+// Uptime 返回代理 since 之后的可用率(0~100)和验证次数, 同一次验证中任一协议成功即视为可用
+func (pdb *ProxyDB) Uptime(ip string, since time.Time) (float64, int, error) {
+	var total int
+	var up float64
+	row := pdb.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*), COALESCE(SUM(ok), 0) FROM (
+		SELECT MAX(success) AS ok FROM %s_checks WHERE ip = ? AND time >= ? GROUP BY time
+	)`, pdb.table), ip, since.Unix())
+	if err := row.Scan(&total, &up); err != nil {
+		return 0, 0, err
+	}
+	if total == 0 {
+		return 0, 0, nil
+	}
+	return up * 100 / float64(total), total, nil
+}
+
+// PruneChecks 删除早于 maxAge 的验证记录, maxPerProxy > 0 时每个代理最多保留最近的 maxPerProxy 条
+func (pdb *ProxyDB) PruneChecks(maxAge time.Duration, maxPerProxy int) error {
+	if maxAge > 0 {
+		_, err := pdb.db.Exec(fmt.Sprintf("DELETE FROM %s_checks WHERE time < ?", pdb.table), time.Now().Add(-maxAge).Unix())
+		if err != nil {
+			return err
+		}
+	}
+	if maxPerProxy > 0 {
+		_, err := pdb.db.Exec(fmt.Sprintf(`DELETE FROM %s_checks WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY ip ORDER BY time DESC, id DESC) AS rn FROM %s_checks
+			) WHERE rn > ?
+		)`, pdb.table, pdb.table), maxPerProxy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -7,18 +7,87 @@ import (
 )
 
 type Config struct {
-	Host          string
-	Port          int
-	DBName        string
-	TableName     string
-	ProxyFetcher  []string
-	HttpURL       string
-	HttpsURL      string
-	VerifyTimeout int
-	MaxFailCount  int
-	PoolSizeMin   int
-	ProxyRegion   bool
-	Timezone      string
+	Host             string
+	Port             int
+	GatewayPort      int    // 转发代理监听端口, 0 表示不启用
+	SocksPort        int    // SOCKS5 转发代理监听端口, 0 表示不启用
+	GatewayUsername  string // 转发代理的认证用户名, 为空时不认证
+	GatewayPassword  string // 转发代理的认证密码
+	GatewayRetries   int    // 转发代理连接上游失败时换一个上游重试的次数
+	SessionTTL       int    // 会话绑定同一个代理的有效期(秒)
+	LeaseTTL         int    // 租约的有效期(秒), 到期未归还时自动释放
+	ApiToken         string // 调用方通过 Authorization: Bearer 或 ?token= 提供后, 接口才返回代理的用户名密码
+	CredentialKey    string // 加密保存代理用户名密码的密钥, 为空时明文保存
+	DBName           string
+	TableName        string
+	ProxyFetcher     []string
+	HttpURL          string
+	HttpsURL         string
+	JudgeURL         string // 返回请求头和来源 IP 的接口, 用于检测匿名级别, 为空时不检测
+	SpeedTestURL     string // 测速文件地址, 通过代理下载以计算速度, 为空时不测速
+	VerifyTimeout    int
+	VerifyTLS        bool               // https 验证时校验证书, 证书无效的代理标记为 MITM
+	CAFile           string             // 校验证书使用的 PEM 格式 CA 文件, 为空时使用系统证书
+	HttpsPin         string             // HttpsURL 证书的 SHA256 指纹, 为空时不固定
+	HttpCheck        ContentCheckConfig // HttpURL 响应内容的断言
+	HttpsCheck       ContentCheckConfig // HttpsURL 响应内容的断言
+	VerifyWorkers    int                // 并发验证协程数
+	VerifyQueueSize  int                // 验证等待队列长度, 队列满时采集源阻塞等待
+	MaxFailCount     int                // 失败次数超过该值的代理在失败时删除, 作为质量分之外的兜底
+	MinScore         int                // 质量分低于该值的代理在失败时删除, 0 表示只按 MaxFailCount 删除
+	ScoreHalfLife    int                // 质量分中历史结果的半衰期(秒)
+	PoolSizeMin      int
+	CheckHistoryDays int    // 验证记录保留的天数, 0 表示不按时间清理
+	CheckHistoryMax  int    // 每个代理最多保留的验证记录条数, 0 表示不限制
+	SelectStrategy   string // /api/get 默认的选择策略: random, weighted, lru, round_robin, latency
+	ProxyRegion      bool   // 是否查询代理的地理位置, 开启时需要指定 GeoBackend
+	GeoBackend       string // 地理位置查询方式: mmdb 读取 MaxMind 数据库, ip2region 读取 xdb 数据库, http 在线查询(需要显式指定)
+	GeoDBPath        string // mmdb 城市库或 ip2region xdb 文件路径
+	GeoASNDBPath     string // mmdb ASN/ISP 库文件路径, 可选
+	GeoLanguage      string // mmdb 地名语言, 如 zh-CN、en
+	Timezone         string
+	Sources          []SourceConfig
+	Profiles         []ProfileConfig
+}
+
+// SourceConfig 声明式采集源配置, 对应 config.toml 中的 [[Sources]]
+type SourceConfig struct {
+	Name      string   // 采集源名称, 需加入 ProxyFetcher 才会启用
+	Type      string   // 采集源类型: html(默认), text, csv, json/jsonl
+	URLs      []string // URL 模板, {page} 会被替换为页码; text/csv/json 类型也可以是本地文件或通配符
+	PageStart int      // 起始页码, 默认 1
+	PageEnd   int      // 结束页码, 默认等于 PageStart
+	Delay     int      // 两次请求之间的间隔(秒)
+	Verify    bool     // 是否校验 TLS 证书
+	Row       string   // 行的 CSS 选择器, 如 "table tr"
+	SkipRows  int      // 跳过的表头行数
+	IP        string   // ip 列: html 为 CSS 选择器, csv 为列名或列序号(从0开始), json 为字段路径; Port 为空时按 ip:port 解析
+	Port      string   // port 列, 规则同 IP
+	Protocol  string   // 协议列, 规则同 IP
+	Regex     string   // 匹配整个页面的正则, 命名分组 ip/port/protocol, 设置后忽略选择器
+	Delimiter string   // csv 分隔符, 默认 ","
+	Root      string   // json 中代理列表所在的字段路径, 为空时取顶层
+}
+
+// ContentCheckConfig 响应内容的断言, 对应 config.toml 中的 [HttpCheck] 和 [HttpsCheck], 所有条件都需满足
+type ContentCheckConfig struct {
+	Contains  string // 需要包含的字符串
+	Regex     string // 需要匹配的正则
+	JSONField string // 响应为 JSON 时需要存在的字段, 以 . 分隔的路径
+	JSONValue string // JSONField 的期望值, 为空时只要求字段非空
+	SHA256    string // 响应内容的 SHA256, 用于已知的固定资源
+}
+
+// ProfileConfig 针对具体目标网站的验证配置, 对应 config.toml 中的 [[Profiles]]
+type ProfileConfig struct {
+	Name       string            // 名称, 用于 /api/get?profile=
+	URL        string            // 访问的地址
+	Method     string            // 请求方法, 默认 GET
+	Headers    map[string]string // 额外的请求头
+	Body       string            // 请求体
+	Status     []int             // 允许的状态码, 默认 [200]
+	BodyRegex  string            // 响应内容需要匹配的正则, 为空时不检查
+	MaxLatency int               // 最大总耗时(毫秒), 0 表示不限制
 }
 
 func NewConfig(filePath string) (*Config, error) {
@@ -28,18 +97,31 @@ func NewConfig(filePath string) (*Config, error) {
 
 func (c *Config) LoadFromFile(filePath string) error {
 	defaultConfig := &Config{
-		Host:          "0.0.0.0",
-		Port:          5010,
-		DBName:        "proxies.db",
-		TableName:     "use_proxy",
-		ProxyFetcher:  []string{"FreeProxy01", "FreeProxy02", "FreeProxy03", "FreeProxy04", "FreeProxy05", "FreeProxy06", "FreeProxy07", "FreeProxy08", "FreeProxy09", "FreeProxy10", "FreeProxy11"},
-		HttpURL:       "http://httpbin.org",
-		HttpsURL:      "https://www.qq.com",
-		VerifyTimeout: 10,
-		MaxFailCount:  0,
-		PoolSizeMin:   20,
-		ProxyRegion:   true,
-		Timezone:      "Asia/Shanghai",
+		Host:             "0.0.0.0",
+		Port:             5010,
+		DBName:           "proxies.db",
+		TableName:        "use_proxy",
+		ProxyFetcher:     []string{"FreeProxy01", "FreeProxy02", "FreeProxy03", "FreeProxy04", "FreeProxy05", "FreeProxy06", "FreeProxy07", "FreeProxy08", "FreeProxy09", "FreeProxy10", "FreeProxy11"},
+		HttpURL:          "http://httpbin.org",
+		HttpsURL:         "https://www.qq.com",
+		JudgeURL:         "http://httpbin.org/get",
+		VerifyTimeout:    10,
+		VerifyTLS:        true,
+		VerifyWorkers:    50,
+		VerifyQueueSize:  500,
+		MaxFailCount:     5,
+		MinScore:         40,
+		ScoreHalfLife:    21600,
+		PoolSizeMin:      20,
+		CheckHistoryDays: 7,
+		CheckHistoryMax:  1000,
+		SelectStrategy:   StrategyRandom,
+		GatewayRetries:   2,
+		SessionTTL:       600,
+		LeaseTTL:         300,
+		ProxyRegion:      false,
+		GeoLanguage:      "zh-CN",
+		Timezone:         "Asia/Shanghai",
 	}
 
 	config, err := toml.LoadFile(filePath)
@@ -54,7 +136,8 @@ func (c *Config) LoadFromFile(filePath string) error {
 		return nil
 	}
 
-	// 从 TOML 文件中加载值并覆盖默认配置
+	// 从 TOML 文件中加载值并覆盖默认配置, 文件中缺失的值保持默认
+	*c = *defaultConfig
 	if err := config.Unmarshal(c); err != nil {
 		return err
 	}
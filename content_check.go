@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// errTampered 响应内容与预期不符, 代理可能注入了广告、跳转到登录页或返回了缓存内容
+var errTampered = errors.New("response content tampered")
+
+// ContentCheck 对验证地址响应内容的断言, 未设置任何条件时不检查
+type ContentCheck struct {
+	contains  string
+	regex     *regexp.Regexp
+	jsonField string
+	jsonValue string
+	sha256    string
+}
+
+// NewContentCheck 根据配置创建 ContentCheck
+func NewContentCheck(cfg ContentCheckConfig) (*ContentCheck, error) {
+	check := &ContentCheck{
+		contains:  cfg.Contains,
+		jsonField: cfg.JSONField,
+		jsonValue: cfg.JSONValue,
+		sha256:    strings.ToLower(cfg.SHA256),
+	}
+	if cfg.Regex != "" {
+		regex, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, err
+		}
+		check.regex = regex
+	}
+	if check.sha256 != "" {
+		if _, err := hex.DecodeString(check.sha256); err != nil || len(check.sha256) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid sha256 %s", cfg.SHA256)
+		}
+	}
+	return check, nil
+}
+
+// Check 检查响应内容, 不符合时返回包装了 errTampered 的错误
+func (c *ContentCheck) Check(body []byte) error {
+	if c == nil {
+		return nil
+	}
+	if c.contains != "" && !bytes.Contains(body, []byte(c.contains)) {
+		return fmt.Errorf("%w: missing %q", errTampered, c.contains)
+	}
+	if c.regex != nil && !c.regex.Match(body) {
+		return fmt.Errorf("%w: not match %s", errTampered, c.regex)
+	}
+	if c.jsonField != "" {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("%w: invalid json", errTampered)
+		}
+		got := jsonString(jsonField(value, c.jsonField))
+		if got == "" || (c.jsonValue != "" && got != c.jsonValue) {
+			return fmt.Errorf("%w: %s = %q", errTampered, c.jsonField, got)
+		}
+	}
+	if c.sha256 != "" {
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != c.sha256 {
+			return fmt.Errorf("%w: sha256 mismatch", errTampered)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// encryptedPrefix 加密后的认证信息在数据库中的前缀
+const encryptedPrefix = "enc:"
+
+// credentialAEAD 加密认证信息使用的密钥, 为 nil 时以明文保存
+var credentialAEAD cipher.AEAD
+
+// SetCredentialKey 设置加密代理用户名密码的密钥, key 为空时以明文保存, 已加密的数据仍需要原密钥才能读取
+func SetCredentialKey(key string) error {
+	if key == "" {
+		credentialAEAD = nil
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	credentialAEAD = aead
+	return nil
+}
+
+// Credential 代理的用户名或密码, 设置了密钥时在数据库中加密保存
+type Credential string
+
+func (c Credential) Value() (driver.Value, error) {
+	if c == "" || credentialAEAD == nil {
+		return string(c), nil
+	}
+	nonce := make([]byte, credentialAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := credentialAEAD.Seal(nonce, nonce, []byte(c), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *Credential) Scan(src interface{}) error {
+	var value string
+	switch v := src.(type) {
+	case nil:
+		*c = ""
+		return nil
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Credential", src)
+	}
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		*c = Credential(value)
+		return nil
+	}
+	if credentialAEAD == nil {
+		return errors.New("credential is encrypted but CredentialKey is not set")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(encryptedPrefix):])
+	if err != nil {
+		return err
+	}
+	size := credentialAEAD.NonceSize()
+	if len(sealed) < size {
+		return errors.New("invalid encrypted credential")
+	}
+	plain, err := credentialAEAD.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return fmt.Errorf("decrypt credential: %w", err)
+	}
+	*c = Credential(plain)
+	return nil
+}
+
+// proxyKey 返回不带认证信息的代理地址 host:port, 作为数据库中代理的唯一标识
+func proxyKey(proxy string) string {
+	_, _, addr := splitProxyAuth(canonicalProxy(proxy))
+	return addr
+}
+
+// redactProxy 隐藏代理地址中的密码, 用于日志输出
+func redactProxy(proxy string) string {
+	username, password, addr := splitProxyAuth(proxy)
+	if username == "" && password == "" {
+		return addr
+	}
+	return username + ":***@" + addr
+}
+
+// apiAuthorized 判断请求是否携带了 ApiToken, 未配置 ApiToken 时所有请求都视为未授权
+func apiAuthorized(r *http.Request) bool {
+	token := app.Config.ApiToken
+	if token == "" {
+		return false
+	}
+	got := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		got = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// exposeProxy 返回可以发送给调用方的代理信息, 未授权时去掉用户名密码
+func exposeProxy(r *http.Request, proxy *ProxyItem) *ProxyItem {
+	if proxy == nil || (proxy.Username == "" && proxy.Password == "") || apiAuthorized(r) {
+		return proxy
+	}
+	redacted := *proxy
+	redacted.Username = ""
+	redacted.Password = ""
+	return &redacted
+}
+
+// setAddr 拆分 user:pass@host:port 格式的代理地址, ip 只保留 host:port
+func (p *ProxyItem) setAddr(proxy string) {
+	username, password, addr := splitProxyAuth(canonicalProxy(proxy))
+	p.IP = addr
+	p.Username = Credential(username)
+	p.Password = Credential(password)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	p.Host = host
+	p.Port, _ = strconv.Atoi(port)
+}
+
+// Addr 返回带认证信息的代理地址 user:pass@host:port, 用于验证和连接上游
+func (p *ProxyItem) Addr() string {
+	if p.Username == "" && p.Password == "" {
+		return p.IP
+	}
+	return string(p.Username) + ":" + string(p.Password) + "@" + p.IP
+}
+
+// httpProxyURL 返回 HTTP 代理的地址, 用户名密码原样保存在 User 中, 不做 URL 解码,
+// 与 CONNECT、SOCKS 拨号时发送的认证信息一致
+func httpProxyURL(proxy string) *url.URL {
+	username, password, addr := splitProxyAuth(proxy)
+	proxyURL := &url.URL{Scheme: "http", Host: addr}
+	if username != "" || password != "" {
+		proxyURL.User = url.UserPassword(username, password)
+	}
+	return proxyURL
+}
+
+// proxyScheme 返回连接代理时使用的协议, 同时支持多种协议时按 protocolChecks 的顺序优先
+func proxyScheme(proxyType int) string {
+	for _, check := range protocolChecks {
+		if proxyType&check.proxyType == 0 {
+			continue
+		}
+		if check.protocol == "https" {
+			// https 通过 HTTP 代理的 CONNECT 隧道访问
+			return "http"
+		}
+		return check.protocol
+	}
+	return ""
+}
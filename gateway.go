@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionHeader 客户端指定会话 ID 的请求头, 与用户名中的 session 参数作用相同
+const sessionHeader = "X-Proxy-Session"
+
+// errNoUpstream 代理池中没有满足条件的上游代理
+var errNoUpstream = errors.New("no available proxy")
+
+// hopHeaders 只在相邻两跳之间有效, 转发时需要去掉的请求头和响应头
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Gateway 内置的 HTTP/HTTPS 和 SOCKS5 转发代理, 每个请求从代理池中选择一个上游代理
+type Gateway struct {
+	db        *ProxyDB
+	strategy  string
+	timeout   time.Duration
+	transport *http.Transport
+	username  string
+	password  string
+	retries   int
+	sessions  *SessionStore
+}
+
+type upstreamKey struct{}
+
+// NewGateway 返回 Gateway 实例, strategy 为选择上游代理的策略, timeout 为连接上游的超时时间(秒)
+func NewGateway(db *ProxyDB, strategy string, timeout int) *Gateway {
+	g := &Gateway{
+		db:       db,
+		strategy: strategy,
+		timeout:  time.Duration(timeout) * time.Second,
+	}
+	g.transport = &http.Transport{
+		// 上游代理保存在请求的 context 中, 连接按上游代理复用
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return req.Context().Value(upstreamKey{}).(*url.URL), nil
+		},
+		DialContext:           (&net.Dialer{Timeout: g.timeout}).DialContext,
+		ResponseHeaderTimeout: g.timeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return g
+}
+
+// SetAuth 设置客户端认证的用户名和密码, username 为空时不认证
+func (g *Gateway) SetAuth(username, password string) {
+	g.username = username
+	g.password = password
+}
+
+// SetRetries 设置连接上游代理失败时换一个上游代理重试的次数
+func (g *Gateway) SetRetries(retries int) {
+	g.retries = retries
+}
+
+// SetSessions 设置会话存储, 同一会话 ID 的请求使用同一个上游代理
+func (g *Gateway) SetSessions(sessions *SessionStore) {
+	g.sessions = sessions
+}
+
+// checkAuth 校验客户端的用户名和密码
+func (g *Gateway) checkAuth(username, password string) bool {
+	if g.username == "" {
+		return true
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(g.username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(g.password)) == 1
+	return userOK && passOK
+}
+
+// gatewayParams 用户名中允许使用的参数
+var gatewayParams = map[string]bool{
+	"type": true, "sort": true, "strategy": true, "anonymity": true, "max_latency": true,
+	"country": true, "exclude_country": true, "isp": true, "asn": true, "mitm": true,
+	"distinct_exit": true, "ipv6": true, "profile": true, "session": true,
+}
+
+// parseGatewayUsername 解析 "user-key-value-key-value" 格式的用户名, 返回用户名和参数;
+// configured 为配置的用户名, 可以包含 "-", 为空时用户名可以省略, 直接以参数开头.
+// 值中的 "-" 需要写成 %2D, 参数未知或不成对时返回错误
+func parseGatewayUsername(username, configured string) (string, url.Values, error) {
+	params := make(url.Values)
+	var user, rest string
+	switch {
+	case configured != "" && username == configured:
+		return username, params, nil
+	case configured != "" && strings.HasPrefix(username, configured+"-"):
+		user, rest = configured, username[len(configured)+1:]
+	case configured != "":
+		// 用户名不匹配, 由调用方按认证失败处理
+		return username, params, nil
+	default:
+		user, rest, _ = strings.Cut(username, "-")
+		if gatewayParams[strings.ToLower(user)] {
+			user, rest = "", username
+		}
+	}
+	if rest == "" {
+		return user, params, nil
+	}
+
+	fields := strings.Split(rest, "-")
+	if len(fields)%2 != 0 {
+		return user, params, fmt.Errorf("invalid username parameters %s", rest)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := strings.ToLower(fields[i])
+		if !gatewayParams[key] {
+			return user, params, fmt.Errorf("unknown username parameter %s", fields[i])
+		}
+		value, err := url.PathUnescape(fields[i+1])
+		if err != nil || value == "" {
+			return user, params, fmt.Errorf("invalid value for %s", key)
+		}
+		params.Add(key, value)
+	}
+	return user, params, nil
+}
+
+// gatewayFilter 将用户名中的参数转换为选择上游代理的条件, 返回条件和会话 ID
+func gatewayFilter(params url.Values) (ProxyFilter, string, error) {
+	filter, err := proxyFilterFromValues(params)
+	if err != nil {
+		return filter, "", err
+	}
+	return filter, params.Get("session"), nil
+}
+
+// tunnelFilter 返回建立隧道时的查询条件和允许使用的协议,
+// filter.Type 中没有 defaultMask 内的协议时, 要求上游代理至少支持 defaultMask 中的一种
+func tunnelFilter(filter ProxyFilter, defaultMask int) (ProxyFilter, int) {
+	mask := filter.Type & defaultMask
+	if mask == 0 {
+		filter.AnyType = defaultMask
+		mask = defaultMask
+	}
+	return filter, mask
+}
+
+// upstream 按 filter 选择一个上游代理, session 不为空时优先使用会话绑定的代理
+func (g *Gateway) upstream(filter ProxyFilter, session string) (*ProxyItem, error) {
+	if filter.Strategy == "" {
+		filter.Strategy = g.strategy
+	}
+	var proxy *ProxyItem
+	var err error
+	if session != "" && g.sessions != nil {
+		proxy, err = g.sessions.Select(g.db, session, filter)
+	} else {
+		proxy, err = g.db.GetBy(filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return nil, errNoUpstream
+	}
+	return proxy, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, _ := proxyBasicAuth(r)
+	user, params, err := parseGatewayUsername(username, g.username)
+	if !g.checkAuth(user, password) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="go_proxy_pool"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, session, err := gatewayFilter(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if header := r.Header.Get(sessionHeader); header != "" {
+		session = header
+	}
+
+	if r.Method == http.MethodConnect {
+		g.serveConnect(w, r, filter, session)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy server, set it as HTTP_PROXY", http.StatusBadRequest)
+		return
+	}
+	g.serveForward(w, r, filter, session)
+}
+
+// serveConnect 通过满足 filter 且支持 HTTPS 的上游代理建立隧道
+func (g *Gateway) serveConnect(w http.ResponseWriter, r *http.Request, filter ProxyFilter, session string) {
+	filter, mask := tunnelFilter(filter, ProxyTypeHTTPS)
+	upConn, err := g.dial(r.Context(), filter, session, mask, r.Host)
+	if err != nil {
+		gatewayError(w, r, err)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upConn.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, buf, err := hijacker.Hijack()
+	if err != nil {
+		upConn.Close()
+		return
+	}
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		upConn.Close()
+		return
+	}
+	// 客户端可能在收到 200 之前就发送了数据
+	if n := buf.Reader.Buffered(); n > 0 {
+		data, _ := buf.Reader.Peek(n)
+		if _, err := upConn.Write(data); err != nil {
+			clientConn.Close()
+			upConn.Close()
+			return
+		}
+	}
+	pipe(clientConn, upConn)
+}
+
+// dial 选择上游代理建立到 addr 的隧道, 连接或握手上游代理失败时换一个上游代理重试, mask 为允许使用的协议.
+// 上游代理已应答但目标不可达时直接返回错误, 不计入代理的失败
+func (g *Gateway) dial(ctx context.Context, filter ProxyFilter, session string, mask int, addr string) (net.Conn, error) {
+	var lastErr error
+	for attempt := 0; attempt <= g.retries; attempt++ {
+		proxy, err := g.upstream(filter, session)
+		if err != nil {
+			if lastErr != nil && errors.Is(err, errNoUpstream) {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, g.timeout)
+		conn, err := dialTunnel(dialCtx, proxy, mask, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		app.logger.Printf("Gateway - %s via %s fail: %s", addr, proxy.IP, err)
+		if targetFailed(err, proxy) {
+			// 目标本身不可达, 换上游代理也无济于事
+			return nil, err
+		}
+		g.markFailed(ctx, proxy)
+		filter.ExcludeIPs = append(filter.ExcludeIPs, proxy.IP)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// serveForward 通过满足 filter 且支持 HTTP 的上游代理转发普通请求, 幂等且没有 body 的请求失败时换一个上游代理重试
+func (g *Gateway) serveForward(w http.ResponseWriter, r *http.Request, filter ProxyFilter, session string) {
+	filter.Type |= ProxyTypeHTTP
+	retries := 0
+	if canRetry(r) {
+		retries = g.retries
+	}
+
+	var resp *http.Response
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		proxy, err := g.upstream(filter, session)
+		if err != nil {
+			if lastErr == nil || !errors.Is(err, errNoUpstream) {
+				lastErr = err
+			}
+			break
+		}
+		proxyURL := httpProxyURL(proxy.Addr())
+		outReq := r.Clone(context.WithValue(r.Context(), upstreamKey{}, proxyURL))
+		outReq.RequestURI = ""
+		removeHopHeaders(outReq.Header)
+		outReq.Header.Del(sessionHeader)
+
+		resp, err = g.transport.RoundTrip(outReq)
+		if err == nil {
+			lastErr = nil
+			break
+		}
+		app.logger.Printf("Gateway - %s %s via %s fail: %s", r.Method, r.URL, proxy.IP, err)
+		g.markFailed(r.Context(), proxy)
+		filter.ExcludeIPs = append(filter.ExcludeIPs, proxy.IP)
+		lastErr = err
+	}
+	if lastErr != nil {
+		gatewayError(w, r, lastErr)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// targetFailed 判断隧道建立失败是否由目标不可达导致, 502/504 只在代理最近一次检测正常时才算
+func targetFailed(err error, proxy *ProxyItem) bool {
+	if errors.Is(err, errTargetGateway) {
+		return proxy.LastStatus
+	}
+	return errors.Is(err, errTargetFailed)
+}
+
+// markFailed 记录上游代理的失败, 客户端主动断开导致的失败不计入
+func (g *Gateway) markFailed(ctx context.Context, proxy *ProxyItem) {
+	if ctx.Err() != nil {
+		return
+	}
+	markProxyFailed(proxy.IP, "Gateway")
+}
+
+// canRetry 判断请求是否可以换一个上游代理重新发送
+func canRetry(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return r.Body == nil || r.Body == http.NoBody
+	}
+	return false
+}
+
+// gatewayError 返回选择或连接上游代理失败的错误
+func gatewayError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errNoUpstream) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Bad Gateway", http.StatusBadGateway)
+}
+
+// proxyBasicAuth 解析 Proxy-Authorization 请求头中的用户名和密码
+func proxyBasicAuth(r *http.Request) (username, password string, ok bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	scheme, encoded, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
+
+// tunnelProtocols 建立隧道时上游代理协议的优先顺序
+var tunnelProtocols = []struct {
+	name      string
+	proxyType int
+}{
+	{"https", ProxyTypeHTTPS},
+	{Socks5, ProxyTypeSocks5},
+	{Socks4a, ProxyTypeSocks4a},
+	{Socks4, ProxyTypeSocks4},
+}
+
+// dialTunnel 通过上游代理建立到 addr 的 TCP 隧道, mask 为允许使用的协议
+func dialTunnel(ctx context.Context, proxy *ProxyItem, mask int, addr string) (net.Conn, error) {
+	for _, protocol := range tunnelProtocols {
+		if proxy.Type&mask&protocol.proxyType == 0 {
+			continue
+		}
+		if protocol.name == "https" {
+			return NewConnectDialer(proxy.Addr()).DialContext(ctx, "tcp", addr)
+		}
+		return NewSocksDialer(protocol.name, proxy.Addr()).DialContext(ctx, "tcp", addr)
+	}
+	return nil, fmt.Errorf("proxy %s does not support tunneling", proxy.IP)
+}
+
+// ConnectDialer 通过 HTTP 代理的 CONNECT 方法建立 TCP 连接
+type ConnectDialer struct {
+	Addr     string // 代理地址 host:port
+	Username string
+	Password string
+}
+
+// NewConnectDialer 返回 ConnectDialer 实例, proxy 格式为 [user:pass@]host:port
+func NewConnectDialer(proxy string) *ConnectDialer {
+	username, password, addr := splitProxyAuth(proxy)
+	return &ConnectDialer{
+		Addr:     addr,
+		Username: username,
+		Password: password,
+	}
+}
+
+// DialContext 连接代理并发送 CONNECT 请求, 返回的连接已经连通到 addr
+func (d *ConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	// CONNECT 的响应没有 body, 不能读取或关闭 resp.Body, 否则会一直等到连接关闭
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout {
+			// 可能是连接目标失败, 也可能是代理自身的上游故障, 由调用方结合代理的状态判断
+			return nil, fmt.Errorf("connect: proxy responded %s: %w", resp.Status, errTargetGateway)
+		}
+		return nil, fmt.Errorf("connect: proxy responded %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		// 代理在响应之后已经发送了目标的数据
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读取 bufio.Reader 中已缓存的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// pipe 在两个连接之间双向复制数据, 任意一方结束后关闭两个连接
+func pipe(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+// gatewayStart 启动转发代理, GatewayPort 和 SocksPort 为 0 时不启用对应的监听
+func gatewayStart() {
+	gateway := NewGateway(app.Database, app.Config.SelectStrategy, app.Config.VerifyTimeout)
+	gateway.SetAuth(app.Config.GatewayUsername, app.Config.GatewayPassword)
+	gateway.SetRetries(app.Config.GatewayRetries)
+	gateway.SetSessions(app.sessions)
+
+	if app.Config.SocksPort != 0 {
+		addr := fmt.Sprintf("%s:%d", app.Config.Host, app.Config.SocksPort)
+		fmt.Printf("Socks5 gateway running on %s\n", addr)
+		go func() {
+			err := gateway.ListenAndServeSocks(addr)
+			if err != nil {
+				app.logger.Println(err)
+			}
+		}()
+	}
+
+	if app.Config.GatewayPort != 0 {
+		addr := fmt.Sprintf("%s:%d", app.Config.Host, app.Config.GatewayPort)
+		fmt.Printf("Gateway running on %s\n", addr)
+		server := &http.Server{
+			Addr:    addr,
+			Handler: gateway,
+		}
+		err := server.ListenAndServe()
+		if err != nil {
+			app.logger.Println(err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 应答码
+const (
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5HostUnreachable     = 0x04
+	socks5CommandNotSupported = 0x07
+	socks5AddrNotSupported    = 0x08
+)
+
+// ListenAndServeSocks 在 addr 上监听 SOCKS5 连接
+func (g *Gateway) ListenAndServeSocks(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return g.ServeSocks(listener)
+}
+
+// ServeSocks 接受 listener 上的 SOCKS5 连接, 只支持 CONNECT 命令
+func (g *Gateway) ServeSocks(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go g.serveSocksConn(conn)
+	}
+}
+
+func (g *Gateway) serveSocksConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(g.timeout))
+	addr, filter, session, err := g.socksHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	filter, mask := tunnelFilter(filter, ProxyTypeSocks5|ProxyTypeHTTPS)
+	upConn, err := g.dial(context.Background(), filter, session, mask, addr)
+	if err != nil {
+		code := byte(socks5HostUnreachable)
+		if errors.Is(err, errNoUpstream) {
+			code = socks5GeneralFailure
+		}
+		socksReply(conn, code)
+		conn.Close()
+		return
+	}
+
+	if err := socksReply(conn, socks5Succeeded); err != nil {
+		conn.Close()
+		upConn.Close()
+		return
+	}
+	pipe(conn, upConn)
+}
+
+// socksHandshake 完成认证并读取 CONNECT 请求, 返回目标地址 host:port 以及用户名中的过滤条件和会话 ID
+func (g *Gateway) socksHandshake(conn net.Conn) (addr string, filter ProxyFilter, session string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", filter, "", err
+	}
+	if header[0] != 0x05 {
+		return "", filter, "", errors.New("socks5: unsupported version")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", filter, "", err
+	}
+
+	// 配置了用户名时要求用户名密码认证; 否则客户端支持时也使用用户名密码认证, 以读取用户名中的参数
+	method := byte(0xff)
+	for _, m := range methods {
+		if m == 0x02 || (m == 0x00 && g.username == "" && method == 0xff) {
+			method = m
+		}
+	}
+	if method == 0xff {
+		conn.Write([]byte{0x05, 0xff})
+		return "", filter, "", errors.New("socks5: no acceptable authentication methods")
+	}
+	if _, err := conn.Write([]byte{0x05, method}); err != nil {
+		return "", filter, "", err
+	}
+	if method == 0x02 {
+		filter, session, err = g.socksAuth(conn)
+		if err != nil {
+			return "", filter, "", err
+		}
+	}
+
+	// 读取请求 VER CMD RSV ATYP
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", filter, "", err
+	}
+	if req[0] != 0x05 {
+		return "", filter, "", errors.New("socks5: unsupported version")
+	}
+	if req[1] != 0x01 {
+		socksReply(conn, socks5CommandNotSupported)
+		return "", filter, "", errors.New("socks5: command not supported")
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == 0x04 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", filter, "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", filter, "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", filter, "", err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socks5AddrNotSupported)
+		return "", filter, "", errors.New("socks5: address type not supported")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", filter, "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), filter, session, nil
+}
+
+// socksAuth 完成 RFC 1929 用户名密码认证, 返回用户名中的过滤条件和会话 ID
+func (g *Gateway) socksAuth(conn net.Conn) (ProxyFilter, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return ProxyFilter{}, "", err
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return ProxyFilter{}, "", err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return ProxyFilter{}, "", err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return ProxyFilter{}, "", err
+	}
+	user, params, err := parseGatewayUsername(string(username), g.username)
+	if header[0] != 0x01 || !g.checkAuth(user, string(password)) {
+		conn.Write([]byte{0x01, 0x01})
+		return ProxyFilter{}, "", errors.New("socks5: authentication failed")
+	}
+	if err != nil {
+		// 参数错误时同样按认证失败处理
+		conn.Write([]byte{0x01, 0x01})
+		return ProxyFilter{}, "", err
+	}
+	filter, session, err := gatewayFilter(params)
+	if err != nil {
+		// 参数错误时同样按认证失败处理
+		conn.Write([]byte{0x01, 0x01})
+		return ProxyFilter{}, "", err
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return filter, session, err
+}
+
+// socksReply 发送 CONNECT 应答, 绑定地址固定为 0.0.0.0:0
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{0x05, code, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
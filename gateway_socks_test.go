@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeConn 从 r 读取客户端发送的数据, 服务端写入的数据保存在 w 中
+type fakeConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *fakeConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// socksUserPass 返回 RFC 1929 用户名密码认证请求
+func socksUserPass(username, password string) []byte {
+	b := []byte{0x01, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	return append(b, password...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestSocksHandshake(t *testing.T) {
+	app = &App{
+		Config:    &Config{SelectStrategy: StrategyRandom},
+		validator: NewProxyValidator("", "", "", 1),
+	}
+
+	noAuth := []byte{0x05, 0x01, 0x00}
+	userPass := []byte{0x05, 0x01, 0x02}
+	connectIPv4 := []byte{0x05, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0x00, 0x50}
+	tests := []struct {
+		name     string
+		username string
+		input    []byte
+		addr     string
+		filter   ProxyFilter
+		session  string
+		reply    []byte
+		wantErr  bool
+	}{
+		{
+			name:  "ipv4 without auth",
+			input: concat(noAuth, connectIPv4),
+			addr:  "1.2.3.4:80",
+			reply: []byte{0x05, 0x00},
+		},
+		{
+			name:  "domain",
+			input: concat(noAuth, []byte{0x05, 0x01, 0x00, 0x03, 11}, []byte("example.com"), []byte{0x01, 0xbb}),
+			addr:  "example.com:443",
+			reply: []byte{0x05, 0x00},
+		},
+		{
+			name:  "ipv6",
+			input: concat(noAuth, []byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1"), []byte{0x1f, 0x90}),
+			addr:  "[2001:db8::1]:8080",
+			reply: []byte{0x05, 0x00},
+		},
+		{
+			name:     "auth with params",
+			username: "user",
+			input:    concat(userPass, socksUserPass("user-country-us-session-abc", "pass"), connectIPv4),
+			addr:     "1.2.3.4:80",
+			filter:   ProxyFilter{Strategy: StrategyRandom, Countries: []string{"us"}},
+			session:  "abc",
+			reply:    []byte{0x05, 0x02, 0x01, 0x00},
+		},
+		{
+			name:     "wrong password",
+			username: "user",
+			input:    concat(userPass, socksUserPass("user", "wrong")),
+			reply:    []byte{0x05, 0x02, 0x01, 0x01},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown param",
+			username: "user",
+			input:    concat(userPass, socksUserPass("user-foo-bar", "pass")),
+			reply:    []byte{0x05, 0x02, 0x01, 0x01},
+			wantErr:  true,
+		},
+		{
+			name:     "unpaired params",
+			username: "user",
+			input:    concat(userPass, socksUserPass("user-session-ab-cd-country-us", "pass")),
+			reply:    []byte{0x05, 0x02, 0x01, 0x01},
+			wantErr:  true,
+		},
+		{
+			name:     "auth required",
+			username: "user",
+			input:    noAuth,
+			reply:    []byte{0x05, 0xff},
+			wantErr:  true,
+		},
+		{
+			name:    "bad version",
+			input:   []byte{0x04, 0x01, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "truncated greeting",
+			input:   []byte{0x05, 0x02, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "empty greeting",
+			input:   nil,
+			wantErr: true,
+		},
+		{
+			name:    "bind not supported",
+			input:   concat(noAuth, []byte{0x05, 0x02, 0x00, 0x01, 1, 2, 3, 4, 0x00, 0x50}),
+			reply:   []byte{0x05, 0x00, 0x05, socks5CommandNotSupported, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "address type not supported",
+			input:   concat(noAuth, []byte{0x05, 0x01, 0x00, 0x05}),
+			reply:   []byte{0x05, 0x00, 0x05, socks5AddrNotSupported, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "truncated port",
+			input:   concat(noAuth, []byte{0x05, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0x00}),
+			reply:   []byte{0x05, 0x00},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGateway(nil, StrategyRandom, 1)
+			g.SetAuth(tt.username, "pass")
+			conn := &fakeConn{r: bytes.NewReader(tt.input)}
+			addr, filter, session, err := g.socksHandshake(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(conn.w.Bytes(), tt.reply) {
+				t.Errorf("reply = %x, want %x", conn.w.Bytes(), tt.reply)
+			}
+			if tt.wantErr {
+				return
+			}
+			if addr != tt.addr {
+				t.Errorf("addr = %q, want %q", addr, tt.addr)
+			}
+			if tt.filter.Strategy == "" {
+				tt.filter.Strategy = StrategyRandom
+			}
+			if session != tt.session {
+				t.Errorf("session = %q, want %q", session, tt.session)
+			}
+			if tt.username != "" && !reflect.DeepEqual(filter, tt.filter) {
+				t.Errorf("filter = %+v, want %+v", filter, tt.filter)
+			}
+		})
+	}
+}
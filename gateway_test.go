@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseGatewayUsername(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		configured string
+		user       string
+		params     url.Values
+		wantErr    bool
+	}{
+		{"user only", "user", "user", "user", url.Values{}, false},
+		{"params", "user-country-us-type-https", "user", "user", url.Values{"country": {"us"}, "type": {"https"}}, false},
+		{"configured user with dash", "my-user-session-abc", "my-user", "my-user", url.Values{"session": {"abc"}}, false},
+		{"key is case insensitive", "user-Country-us", "user", "user", url.Values{"country": {"us"}}, false},
+		{"repeated key", "user-country-us-country-jp", "user", "user", url.Values{"country": {"us", "jp"}}, false},
+		{"escaped dash in value", "user-session-a%2Db-country-us", "user", "user", url.Values{"session": {"a-b"}, "country": {"us"}}, false},
+		{"other user is left to auth", "other-country-us", "user", "other-country-us", url.Values{}, false},
+		{"unpaired params", "user-session-ab-cd-country-us", "user", "user", nil, true},
+		{"trailing key", "user-country", "user", "user", nil, true},
+		{"unknown key", "user-foo-bar", "user", "user", nil, true},
+		{"empty value", "user-country--type-https", "user", "user", nil, true},
+		{"bad escape", "user-session-a%zz", "user", "user", nil, true},
+		{"no configured user", "user-session-abc", "", "user", url.Values{"session": {"abc"}}, false},
+		{"no configured user, params only", "country-us-type-https", "", "", url.Values{"country": {"us"}, "type": {"https"}}, false},
+		{"no configured user, unpaired", "session-ab-cd-country-us", "", "", nil, true},
+		{"empty username", "", "", "", url.Values{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, params, err := parseGatewayUsername(tt.username, tt.configured)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if user != tt.user {
+				t.Errorf("user = %q, want %q", user, tt.user)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(params, tt.params) {
+				t.Errorf("params = %v, want %v", params, tt.params)
+			}
+		})
+	}
+}
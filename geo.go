@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GeoInfo 代理 IP 的地理位置信息
+type GeoInfo struct {
+	CountryCode string `json:"countryCode"` // ISO 3166-1 国家代码, 如 CN
+	Country     string `json:"country"`
+	Region      string `json:"region"` // 省份/州
+	City        string `json:"city"`
+	ISP         string `json:"isp"`
+	ASN         uint   `json:"asn"`
+}
+
+// String 返回以空格分隔的地址, 如 "中国 上海 上海 电信"
+func (g *GeoInfo) String() string {
+	var parts []string
+	for _, part := range []string{g.Country, g.Region, g.City, g.ISP} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// GeoResolver 根据 IP 查询地理位置
+type GeoResolver interface {
+	Resolve(ctx context.Context, ip string) (*GeoInfo, error)
+}
+
+// NewGeoResolver 根据配置创建 GeoResolver, backend 为 http、mmdb 或 ip2region
+func NewGeoResolver(backend, dbPath, asnDBPath, language string, timeout int) (GeoResolver, error) {
+	switch backend {
+	case "":
+		return nil, fmt.Errorf("GeoBackend is required: mmdb, ip2region or http")
+	case "http":
+		return NewHTTPGeoResolver(time.Duration(timeout) * time.Second), nil
+	case "mmdb":
+		return NewMMDBGeoResolver(dbPath, asnDBPath, language)
+	case "ip2region":
+		return NewXDBGeoResolver(dbPath)
+	}
+	return nil, fmt.Errorf("unknown geo backend %s", backend)
+}
+
+// HTTPGeoResolver 通过 searchplugin.csdn.net 在线查询地理位置
+type HTTPGeoResolver struct {
+	client *http.Client
+}
+
+// NewHTTPGeoResolver 返回 HTTPGeoResolver 实例, 请求遵循 HTTP_PROXY/HTTPS_PROXY 环境变量
+func NewHTTPGeoResolver(timeout time.Duration) *HTTPGeoResolver {
+	return &HTTPGeoResolver{
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+			Timeout:   timeout,
+		},
+	}
+}
+
+type IPData struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data Data   `json:"data"`
+}
+
+type Data struct {
+	Address string `json:"address"`
+	IP      string `json:"ip"`
+}
+
+// Resolve 返回的JSON结构 {"code":200,"msg":"success","data":{"address":"中国 上海 上海 电信","ip":"101.230.187.69"}}
+func (r *HTTPGeoResolver) Resolve(ctx context.Context, ip string) (*GeoInfo, error) {
+	httpsUrl := fmt.Sprintf("https://searchplugin.csdn.net/api/v1/ip/get?ip=%s", url.QueryEscape(ip))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipData IPData
+	err = json.Unmarshal(body, &ipData)
+	if err != nil {
+		return nil, err
+	}
+
+	if ipData.Code != 200 {
+		return nil, fmt.Errorf("API response code is not 200")
+	}
+	return parseAddress(ipData.Data.Address), nil
+}
+
+// countryCodes 常见国家中文名对应的国家代码
+var countryCodes = map[string]string{
+	"中国":    "CN",
+	"香港":    "HK",
+	"澳门":    "MO",
+	"台湾":    "TW",
+	"美国":    "US",
+	"日本":    "JP",
+	"韩国":    "KR",
+	"新加坡":   "SG",
+	"俄罗斯":   "RU",
+	"德国":    "DE",
+	"法国":    "FR",
+	"英国":    "GB",
+	"荷兰":    "NL",
+	"加拿大":   "CA",
+	"澳大利亚":  "AU",
+	"印度":    "IN",
+	"印度尼西亚": "ID",
+	"巴西":    "BR",
+	"越南":    "VN",
+	"泰国":    "TH",
+}
+
+// parseAddress 解析 "国家 省份 城市 运营商" 格式的地址
+func parseAddress(address string) *GeoInfo {
+	fields := strings.Fields(address)
+	geo := &GeoInfo{}
+	if len(fields) > 0 {
+		geo.Country = fields[0]
+		geo.CountryCode = countryCodes[fields[0]]
+	}
+	switch len(fields) {
+	case 0, 1:
+	case 2:
+		geo.Region = fields[1]
+	case 3:
+		geo.Region, geo.City = fields[1], fields[2]
+	default:
+		geo.Region, geo.City, geo.ISP = fields[1], fields[2], strings.Join(fields[3:], " ")
+	}
+	return geo
+}
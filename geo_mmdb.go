@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MMDBGeoResolver 读取本地 MaxMind 格式(.mmdb)数据库离线查询地理位置,
+// 城市库如 GeoLite2-City, ASN/ISP 库如 GeoLite2-ASN, 两者可以只配置一个
+type MMDBGeoResolver struct {
+	city     *maxminddb.Reader
+	asn      *maxminddb.Reader
+	language string
+}
+
+type mmdbNames map[string]string
+
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string    `maxminddb:"iso_code"`
+		Names   mmdbNames `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names mmdbNames `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names mmdbNames `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ISP   string `maxminddb:"isp"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewMMDBGeoResolver 返回 MMDBGeoResolver 实例, language 为地名语言, 如 zh-CN、en
+func NewMMDBGeoResolver(cityPath, asnPath, language string) (*MMDBGeoResolver, error) {
+	if cityPath == "" && asnPath == "" {
+		return nil, fmt.Errorf("mmdb path is empty")
+	}
+	r := &MMDBGeoResolver{language: language}
+	if cityPath != "" {
+		reader, err := maxminddb.Open(cityPath)
+		if err != nil {
+			return nil, err
+		}
+		r.city = reader
+	}
+	if asnPath != "" {
+		reader, err := maxminddb.Open(asnPath)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.asn = reader
+	}
+	return r, nil
+}
+
+func (r *MMDBGeoResolver) Resolve(ctx context.Context, ip string) (*GeoInfo, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid ip %s", ip)
+	}
+
+	geo := &GeoInfo{}
+	if r.city != nil {
+		var record mmdbRecord
+		if err := r.city.Lookup(addr, &record); err != nil {
+			return nil, err
+		}
+		geo.CountryCode = record.Country.ISOCode
+		geo.Country = record.Country.Names.get(r.language)
+		if len(record.Subdivisions) > 0 {
+			geo.Region = record.Subdivisions[0].Names.get(r.language)
+		}
+		geo.City = record.City.Names.get(r.language)
+		// GeoIP2-ISP 等库中同时包含运营商和 ASN
+		geo.ISP = record.ISP
+		geo.ASN = record.ASN
+	}
+	if r.asn != nil {
+		var record mmdbRecord
+		if err := r.asn.Lookup(addr, &record); err != nil {
+			return nil, err
+		}
+		if record.ISP != "" {
+			geo.ISP = record.ISP
+		} else if geo.ISP == "" {
+			geo.ISP = record.ASOrg
+		}
+		if record.ASN != 0 {
+			geo.ASN = record.ASN
+		}
+	}
+	return geo, nil
+}
+
+// Close 关闭数据库文件
+func (r *MMDBGeoResolver) Close() {
+	if r.city != nil {
+		r.city.Close()
+	}
+	if r.asn != nil {
+		r.asn.Close()
+	}
+}
+
+// get 返回指定语言的名称, 没有时使用英文
+func (n mmdbNames) get(language string) string {
+	if name, ok := n[language]; ok {
+		return name
+	}
+	return n["en"]
+}
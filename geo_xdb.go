@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ip2region xdb 文件格式常量
+const (
+	xdbHeaderLength    = 256
+	xdbVectorIndexRows = 256
+	xdbVectorIndexCols = 256
+	xdbVectorIndexSize = 8
+	xdbSegmentSize     = 14
+)
+
+var errXDBNotFound = errors.New("ip not found in xdb")
+
+// XDBGeoResolver 读取本地 ip2region xdb 数据库离线查询地理位置, 仅支持 IPv4
+type XDBGeoResolver struct {
+	content []byte
+}
+
+// NewXDBGeoResolver 返回 XDBGeoResolver 实例, 数据库文件会整体加载到内存中
+func NewXDBGeoResolver(dbPath string) (*XDBGeoResolver, error) {
+	if dbPath == "" {
+		return nil, errors.New("xdb path is empty")
+	}
+	content, err := os.ReadFile(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < xdbHeaderLength+xdbVectorIndexRows*xdbVectorIndexCols*xdbVectorIndexSize {
+		return nil, fmt.Errorf("invalid xdb file %s", dbPath)
+	}
+	return &XDBGeoResolver{content: content}, nil
+}
+
+// Resolve 查询结果格式为 "国家|区域|省份|城市|ISP", 未知字段为 0
+func (r *XDBGeoResolver) Resolve(ctx context.Context, ip string) (*GeoInfo, error) {
+	addr := net.ParseIP(ip).To4()
+	if addr == nil {
+		return nil, fmt.Errorf("ip2region only supports IPv4: %s", ip)
+	}
+	region, err := r.search(binary.BigEndian.Uint32(addr))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ip, err)
+	}
+
+	fields := strings.Split(region, "|")
+	for i, field := range fields {
+		if field == "0" {
+			fields[i] = ""
+		}
+	}
+	for len(fields) < 5 {
+		fields = append(fields, "")
+	}
+	return &GeoInfo{
+		CountryCode: countryCodes[fields[0]],
+		Country:     fields[0],
+		Region:      fields[2],
+		City:        fields[3],
+		ISP:         fields[4],
+	}, nil
+}
+
+func (r *XDBGeoResolver) search(ip uint32) (string, error) {
+	// 先通过向量索引定位段索引范围, 再二分查找
+	il0, il1 := int(ip>>24&0xFF), int(ip>>16&0xFF)
+	idx := xdbHeaderLength + il0*xdbVectorIndexCols*xdbVectorIndexSize + il1*xdbVectorIndexSize
+	sPtr := int(binary.LittleEndian.Uint32(r.content[idx:]))
+	ePtr := int(binary.LittleEndian.Uint32(r.content[idx+4:]))
+	if sPtr == 0 || ePtr < sPtr || ePtr+xdbSegmentSize > len(r.content) {
+		return "", errXDBNotFound
+	}
+
+	l, h := 0, (ePtr-sPtr)/xdbSegmentSize
+	for l <= h {
+		m := (l + h) >> 1
+		p := sPtr + m*xdbSegmentSize
+		segment := r.content[p : p+xdbSegmentSize]
+		if ip < binary.LittleEndian.Uint32(segment) {
+			h = m - 1
+		} else if ip > binary.LittleEndian.Uint32(segment[4:]) {
+			l = m + 1
+		} else {
+			dataLen := int(binary.LittleEndian.Uint16(segment[8:]))
+			dataPtr := int(binary.LittleEndian.Uint32(segment[10:]))
+			if dataPtr+dataLen > len(r.content) {
+				return "", errors.New("invalid xdb data pointer")
+			}
+			return string(r.content[dataPtr : dataPtr+dataLen]), nil
+		}
+	}
+	return "", errXDBNotFound
+}
@@ -7,6 +7,7 @@ require (
 	github.com/go-co-op/gocron v1.35.2
 	github.com/gorilla/mux v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/oschwald/maxminddb-golang v1.12.0
 	github.com/pelletier/go-toml v1.9.5
 )
 
@@ -16,4 +17,5 @@ require (
 	github.com/robfig/cron/v3 v3.0.1 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
 )
@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type ProxyItemString struct {
@@ -18,6 +22,10 @@ type ProxyItemString struct {
 	FailCount  int    `json:"failCount"`
 	LastTime   string `json:"lastTime"`
 	LastStatus bool   `json:"lastStatus"`
+	Anonymity  string `json:"anonymity"`
+	Latency    int64  `json:"latency"`
+	Throughput string `json:"throughput"`
+	Score      string `json:"score"`
 }
 
 func httpStart() {
@@ -29,7 +37,12 @@ func httpStart() {
 	router.HandleFunc("/api/get", getProxy).Methods("GET")
 	router.HandleFunc("/api/pop", popProxy).Methods("GET")
 	router.HandleFunc("/api/delete", deleteProxy).Methods("GET")
+	router.HandleFunc("/api/lease", leaseProxy).Methods("POST")
+	router.HandleFunc("/api/release", releaseProxy).Methods("POST")
+	router.HandleFunc("/api/report", reportProxy).Methods("POST")
+	router.HandleFunc("/api/proxy/{ip}/history", proxyHistory).Methods("GET")
 	router.HandleFunc("/api/count", couuntProxy).Methods("GET")
+	router.HandleFunc("/judge", judgeHandler)
 
 	addr := fmt.Sprintf("%s:%d", app.Config.Host, app.Config.Port) // 指定监听的地址和端口号
 	fmt.Printf("Server running on %s\n", addr)
@@ -40,17 +53,25 @@ func httpStart() {
 }
 
 func apiIndex(w http.ResponseWriter, r *http.Request) {
-	apiList := `[{"url": "/api/get", "params": "type: ''https'|''", "desc": "get a proxy"},
-{"url": "/api/pop", "params": "", "desc": "get and delete a proxy"},
-{"url": "/api/delete", "params": "proxy: 'e.g. 127.0.0.1:8080'", "desc": "delete an unable proxy"},
-{"url": "/api/all", "params": "type: ''https'|''", "desc": "get all proxy from proxy pool"},
-{"url": "/api/count", "params": "", "desc": "return proxy count"}]`
+	apiList := `[{"url": "/api/get", "params": "type: ''https'|''; anonymity: 'transparent'|'anonymous'|'elite'; max_latency: 'e.g. 500ms'; country/exclude_country: 'e.g. CN,US'; isp: 'e.g. 电信'; asn: 'e.g. 4134'; profile: 'e.g. shop_x'; mitm: 'true' to include MITM proxies with type=https; distinct_exit: 'true'; ipv6: 'true'|'false'; strategy: 'random'|'weighted'|'lru'|'round_robin'|'latency'|'score'; session: 'e.g. abc'", "desc": "get a proxy"},
+{"url": "/api/pop", "params": "same as /api/get", "desc": "get and delete a proxy"},
+{"url": "/api/delete", "params": "proxy: 'e.g. 127.0.0.1:8080'|'[2001:db8::1]:8080'|'proxy.example.com:8080'", "desc": "delete an unable proxy"},
+{"url": "/api/lease", "params": "POST, same as /api/get", "desc": "lease a proxy for exclusive use"},
+{"url": "/api/release", "params": "POST, id: lease id; success: 'true'|'false'", "desc": "release a leased proxy and report the outcome"},
+{"url": "/api/report", "params": "POST, proxy: 'e.g. 127.0.0.1:8080'; host: 'e.g. www.example.com'; outcome: 'success'|'blocked'|'captcha'|'forbidden'|'timeout'|'error'; latency: 'e.g. 500ms'", "desc": "report the outcome of using a proxy"},
+{"url": "/api/all", "params": "same as /api/get; sort: 'latency'|'throughput'|'score'", "desc": "get all proxy from proxy pool"},
+{"url": "/api/count", "params": "", "desc": "return proxy count and unique exit count"},
+{"url": "/api/proxy/{ip}/history", "params": "since: 'e.g. 24h'|'7d'; limit: 'e.g. 100'", "desc": "return check history and uptime of a proxy"}]`
 	jsonDataHandler(w, r, []byte(apiList))
 }
 
 func jsonHandler(w http.ResponseWriter, r *http.Request, proxies []*ProxyItem) {
 	w.Header().Set("Content-Type", "application/json")
-	jsonData, err := json.Marshal(proxies)
+	exposed := make([]*ProxyItem, len(proxies))
+	for i, proxy := range proxies {
+		exposed[i] = exposeProxy(r, proxy)
+	}
+	jsonData, err := json.Marshal(exposed)
 	if err != nil {
 		log.Println("Error marshaling JSON:", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -108,6 +129,10 @@ func htmlHandler(w http.ResponseWriter, r *http.Request, proxies []*ProxyItem) {
 					<th>失败次数</th>
 					<th>最近时间</th>
 					<th>最近状态</th>
+					<th>匿名级别</th>
+					<th>延迟(ms)</th>
+					<th>速度(KB/s)</th>
+					<th>质量分</th>
 				</tr>
 				{{range .}}
 				<tr>
@@ -118,6 +143,10 @@ func htmlHandler(w http.ResponseWriter, r *http.Request, proxies []*ProxyItem) {
 					<td>{{.FailCount}}</td>
 					<td>{{.LastTime}}</td>
 					<td>{{.LastStatus}}</td>
+					<td>{{.Anonymity}}</td>
+					<td>{{.Latency}}</td>
+					<td>{{.Throughput}}</td>
+					<td>{{.Score}}</td>
 				</tr>
 				{{end}}
 			</table>
@@ -134,26 +163,22 @@ func htmlHandler(w http.ResponseWriter, r *http.Request, proxies []*ProxyItem) {
 
 	var proxyDataList []ProxyItemString
 	for _, proxy := range proxies {
-		// 根据 .Type 类型转换为相应的字符串
-		var typeString string
-		if proxy.Type&0x01 == 0x01 {
-			typeString = "HTTP"
-		}
-		if proxy.Type&0x10 == 0x10 {
-			typeString += "|HTTPS"
-		}
-		if proxy.Type&0x100 == 0x100 {
-			typeString += "|SOCK5"
+		// 没有符合条件的代理时 getProxy 传入 nil, 显示空表格
+		if proxy == nil {
+			continue
 		}
-
 		proxyData := ProxyItemString{
 			IP:         proxy.IP,
-			TypeString: typeString,
+			TypeString: proxyTypeString(proxy.Type),
 			Address:    proxy.Address,
 			CheckCount: proxy.CheckCount,
 			FailCount:  proxy.FailCount,
 			LastTime:   proxy.LastTime,
 			LastStatus: proxy.LastStatus,
+			Anonymity:  proxy.Anonymity.String(),
+			Latency:    proxy.Latency,
+			Throughput: fmt.Sprintf("%.1f", proxy.Throughput),
+			Score:      fmt.Sprintf("%.1f", proxy.Score),
 		}
 
 		proxyDataList = append(proxyDataList, proxyData)
@@ -167,19 +192,12 @@ func htmlHandler(w http.ResponseWriter, r *http.Request, proxies []*ProxyItem) {
 	}
 }
 func getAllProxies(w http.ResponseWriter, r *http.Request) {
-	queryType := r.URL.Query().Get("type")
-	proxyType := 0
-	if queryType == "https" {
-		proxyType = 0x10
-	} else if queryType == "sock5" {
-		proxyType = 0x100
-	}
-	var proxies []*ProxyItem
-	if proxyType > 0 {
-		proxies, _ = app.Database.GetAllType(proxyType)
-	} else {
-		proxies, _ = app.Database.GetAll()
+	filter, err := proxyFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	proxies, _ := app.Database.GetAllBy(filter)
 	if strings.HasPrefix(r.RequestURI, "/api/all") {
 		jsonHandler(w, r, proxies)
 	} else {
@@ -188,18 +206,16 @@ func getAllProxies(w http.ResponseWriter, r *http.Request) {
 }
 
 func getProxy(w http.ResponseWriter, r *http.Request) {
-	queryType := r.URL.Query().Get("type")
-	proxyType := 0
-	if queryType == "https" {
-		proxyType = 0x10
-	} else if queryType == "sock5" {
-		proxyType = 0x100
+	filter, err := proxyFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	var proxy *ProxyItem
-	if proxyType > 0 {
-		proxy, _ = app.Database.GetType(proxyType)
+	if session := r.URL.Query().Get("session"); session != "" {
+		proxy, _ = app.sessions.Select(app.Database, session, filter)
 	} else {
-		proxy, _ = app.Database.Get()
+		proxy, _ = app.Database.GetBy(filter)
 	}
 	if strings.HasPrefix(r.RequestURI, "/api/get") {
 		jsonHandler(w, r, []*ProxyItem{proxy})
@@ -209,12 +225,196 @@ func getProxy(w http.ResponseWriter, r *http.Request) {
 }
 
 func popProxy(w http.ResponseWriter, r *http.Request) {
-	proxy, _ := app.Database.Pop()
+	filter, err := proxyFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proxy, _ := app.Database.PopBy(filter)
 	jsonHandler(w, r, []*ProxyItem{proxy})
 }
 
+// leaseProxy 租用一个代理, 在归还或 LeaseTTL 到期之前不会被再次租用
+func leaseProxy(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := proxyFilterFromValues(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lease, err := app.Database.Lease(filter, time.Duration(app.Config.LeaseTTL)*time.Second)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if lease == nil {
+		http.Error(w, "no available proxy", http.StatusServiceUnavailable)
+		return
+	}
+	lease.Proxy = exposeProxy(r, lease.Proxy)
+
+	jsonData, err := json.Marshal(lease)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	jsonDataHandler(w, r, jsonData)
+}
+
+// releaseProxy 归还租用的代理, success 为使用结果, 用于更新代理的失败次数和质量分
+func releaseProxy(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var success *bool
+	if value := r.Form.Get("success"); value != "" {
+		ok, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid success %s", value), http.StatusBadRequest)
+			return
+		}
+		success = &ok
+	}
+
+	ip, err := app.Database.Release(r.Form.Get("id"))
+	if errors.Is(err, errLeaseNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if success != nil {
+		if *success {
+			markProxySucceeded(ip, "Lease")
+		} else {
+			markProxyFailed(ip, "Lease")
+		}
+	}
+	jsonDataHandler(w, r, []byte(`{"code":0, "status":"success"}`))
+}
+
+// reportProxy 记录客户端上报的使用结果, 并更新代理的延迟、失败次数和质量分
+func reportProxy(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := &Report{
+		IP:      proxyKey(r.Form.Get("proxy")),
+		Host:    r.Form.Get("host"),
+		Outcome: r.Form.Get("outcome"),
+		Time:    time.Now(),
+	}
+	if !ValidOutcome(report.Outcome) {
+		http.Error(w, fmt.Sprintf("unknown outcome %s", report.Outcome), http.StatusBadRequest)
+		return
+	}
+	if latency := r.Form.Get("latency"); latency != "" {
+		d, err := parseLatency("latency", latency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report.Latency = d.Milliseconds()
+	}
+
+	proxy, err := app.Database.GetByIP(report.IP)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if proxy == nil {
+		http.Error(w, "proxy not found", http.StatusNotFound)
+		return
+	}
+	if err := app.Database.AddReport(report); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	applyReport(proxy.IP, report)
+	jsonDataHandler(w, r, []byte(`{"code":0, "status":"success"}`))
+}
+
+// ProxyHistory 代理的验证记录和可用率
+type ProxyHistory struct {
+	IP     string        `json:"ip"`
+	Uptime float64       `json:"uptime"` // since 之后的可用率(%)
+	Rounds int           `json:"rounds"` // since 之后的验证次数
+	Checks []CheckRecord `json:"checks"` // 验证记录, 按时间从新到旧
+}
+
+// proxyHistory 返回代理的验证记录, ?since= 为时间范围(默认 24h), ?limit= 为最多返回的记录数(默认 100)
+func proxyHistory(w http.ResponseWriter, r *http.Request) {
+	ip := proxyKey(mux.Vars(r)["ip"])
+	query := r.URL.Query()
+	since := 24 * time.Hour
+	if value := query.Get("since"); value != "" {
+		var err error
+		since, err = parseSince(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %s", value), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	start := time.Now().Add(-since)
+	history := ProxyHistory{IP: ip}
+	var err error
+	history.Uptime, history.Rounds, err = app.Database.Uptime(ip, start)
+	if err == nil {
+		history.Checks, err = app.Database.GetChecks(ip, start, limit)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(history)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	jsonDataHandler(w, r, jsonData)
+}
+
+// parseSince 解析时间范围参数, 支持 30m、24h 等格式, 以及 7d 表示天数
+func parseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid since %s", s)
+	}
+	return d, nil
+}
+
 func deleteProxy(w http.ResponseWriter, r *http.Request) {
-	proxy := r.URL.Query().Get("proxy")
+	proxy := proxyKey(r.URL.Query().Get("proxy"))
 	var jsonData string
 	err := app.Database.Delete(proxy)
 	if err != nil {
@@ -229,6 +429,136 @@ func deleteProxy(w http.ResponseWriter, r *http.Request) {
 
 func couuntProxy(w http.ResponseWriter, r *http.Request) {
 	proxies, _ := app.Database.GetAll()
-	jsonData := fmt.Sprintf("{\"count\":%d}", len(proxies))
+	exits, _ := app.Database.CountExits()
+	jsonData := fmt.Sprintf("{\"count\":%d, \"unique_exits\":%d}", len(proxies), exits)
 	jsonDataHandler(w, r, []byte(jsonData))
 }
+
+// proxyFilterFromQuery 解析 ?type=、?anonymity=、?max_latency=、?sort=、?strategy=、?country=、?profile= 等查询参数,
+// anonymity 为最低匿名级别, 如 anonymous 同时返回 anonymous 和 elite
+func proxyFilterFromQuery(r *http.Request) (ProxyFilter, error) {
+	return proxyFilterFromValues(r.URL.Query())
+}
+
+// proxyFilterFromValues 将查询参数转换为 ProxyFilter, 也用于转发代理用户名中的参数
+func proxyFilterFromValues(query url.Values) (ProxyFilter, error) {
+	filter := ProxyFilter{
+		Type:     proxyTypeFromQuery(query.Get("type")),
+		Sort:     query.Get("sort"),
+		Strategy: query.Get("strategy"),
+	}
+	if filter.Strategy == "" {
+		filter.Strategy = app.Config.SelectStrategy
+	}
+	if !ValidStrategy(filter.Strategy) {
+		return filter, fmt.Errorf("unknown strategy %s", filter.Strategy)
+	}
+	anonymity, err := ParseAnonymity(query.Get("anonymity"))
+	if err != nil {
+		return filter, err
+	}
+	filter.Anonymity = anonymity
+	if maxLatency := query.Get("max_latency"); maxLatency != "" {
+		filter.MaxLatency, err = parseLatency("max_latency", maxLatency)
+		if err != nil {
+			return filter, err
+		}
+	}
+	filter.Countries = splitQuery(query["country"])
+	filter.ExcludeCountries = splitQuery(query["exclude_country"])
+	filter.ISP = query.Get("isp")
+	for _, asn := range splitQuery(query["asn"]) {
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+		if err != nil {
+			return filter, fmt.Errorf("invalid asn %s", asn)
+		}
+		filter.ASNs = append(filter.ASNs, uint(n))
+	}
+	if mitm := query.Get("mitm"); mitm != "" {
+		filter.AllowMITM, err = strconv.ParseBool(mitm)
+		if err != nil {
+			return filter, fmt.Errorf("invalid mitm %s", mitm)
+		}
+	}
+	if distinct := query.Get("distinct_exit"); distinct != "" {
+		filter.DistinctExit, err = strconv.ParseBool(distinct)
+		if err != nil {
+			return filter, fmt.Errorf("invalid distinct_exit %s", distinct)
+		}
+	}
+	if ipv6 := query.Get("ipv6"); ipv6 != "" {
+		v, err := strconv.ParseBool(ipv6)
+		if err != nil {
+			return filter, fmt.Errorf("invalid ipv6 %s", ipv6)
+		}
+		filter.IPv6 = &v
+	}
+	filter.Profile = query.Get("profile")
+	if filter.Profile != "" && !app.validator.HasProfile(filter.Profile) {
+		return filter, fmt.Errorf("unknown profile %s", filter.Profile)
+	}
+	return filter, nil
+}
+
+// splitQuery 拆分可重复或以逗号分隔的查询参数, 如 ?country=CN,US&country=JP
+func splitQuery(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// parseLatency 解析名为 name 的耗时参数, 支持 500ms、1.5s 等格式, 纯数字按毫秒处理
+func parseLatency(name, s string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(s); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s", name, s)
+	}
+	return d, nil
+}
+
+// proxyTypeFromQuery 将 ?type= 参数转换为代理类型掩码, 0 表示不过滤
+func proxyTypeFromQuery(queryType string) int {
+	switch strings.ToLower(queryType) {
+	case "http":
+		return ProxyTypeHTTP
+	case "https":
+		return ProxyTypeHTTPS
+	case "sock5", "socks5":
+		return ProxyTypeSocks5
+	case "socks4":
+		return ProxyTypeSocks4
+	case "socks4a":
+		return ProxyTypeSocks4a
+	}
+	return 0
+}
+
+// proxyTypeString 根据代理类型掩码转换为相应的字符串
+func proxyTypeString(proxyType int) string {
+	var names []string
+	if proxyType&ProxyTypeHTTP != 0 {
+		names = append(names, "HTTP")
+	}
+	if proxyType&ProxyTypeHTTPS != 0 {
+		names = append(names, "HTTPS")
+	}
+	if proxyType&ProxyTypeSocks5 != 0 {
+		names = append(names, "SOCKS5")
+	}
+	if proxyType&ProxyTypeSocks4 != 0 {
+		names = append(names, "SOCKS4")
+	}
+	if proxyType&ProxyTypeSocks4a != 0 {
+		names = append(names, "SOCKS4A")
+	}
+	return strings.Join(names, "|")
+}
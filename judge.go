@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Anonymity 代理匿名级别, 数值越大越匿名
+type Anonymity int
+
+const (
+	AnonymityUnknown     Anonymity = iota // 未检测
+	AnonymityTransparent                  // 透明代理, 目标能看到真实 IP
+	AnonymityAnonymous                    // 普通匿名, 目标能看出使用了代理
+	AnonymityElite                        // 高匿, 目标看不出使用了代理
+)
+
+var anonymityNames = []string{"unknown", "transparent", "anonymous", "elite"}
+
+func (a Anonymity) String() string {
+	if a < 0 || int(a) >= len(anonymityNames) {
+		return anonymityNames[AnonymityUnknown]
+	}
+	return anonymityNames[a]
+}
+
+func (a Anonymity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *Anonymity) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseAnonymity(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// ParseAnonymity 解析匿名级别名称, 空字符串返回 AnonymityUnknown
+func ParseAnonymity(s string) (Anonymity, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return AnonymityUnknown, nil
+	}
+	for i, name := range anonymityNames {
+		if name == s {
+			return Anonymity(i), nil
+		}
+	}
+	return AnonymityUnknown, fmt.Errorf("unknown anonymity %s", s)
+}
+
+// proxyHeaders 代理常见的会暴露自身的请求头
+var proxyHeaders = []string{
+	"Via",
+	"Forwarded",
+	"Forwarded-For",
+	"X-Forwarded-For",
+	"X-Forwarded",
+	"X-Forwarded-Host",
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"Client-Ip",
+	"X-Proxy-Id",
+	"Proxy-Connection",
+	"X-Bluecoat-Via",
+}
+
+// JudgeResponse judge 接口返回的内容, 与 httpbin.org/get 格式兼容
+type JudgeResponse struct {
+	Origin  string            `json:"origin"`
+	Headers map[string]string `json:"headers"`
+}
+
+// judgeHandler 内置的 judge 接口, 返回请求头和来源 IP, 可部署在自己的服务器上作为 JudgeURL
+func judgeHandler(w http.ResponseWriter, r *http.Request) {
+	origin, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		origin = r.RemoteAddr
+	}
+	resp := JudgeResponse{
+		Origin:  origin,
+		Headers: map[string]string{"Host": r.Host},
+	}
+	for key, values := range r.Header {
+		resp.Headers[key] = strings.Join(values, ", ")
+	}
+
+	jsonData, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	jsonDataHandler(w, r, jsonData)
+}
+
+// exitIP 返回 judge 看到的出口 IP, origin 包含多个 IP 时最后一个为直接连接 judge 的地址
+func exitIP(judge *JudgeResponse) string {
+	origins := strings.Split(judge.Origin, ",")
+	ip := net.ParseIP(strings.TrimSpace(origins[len(origins)-1]))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// classifyAnonymity 根据 judge 返回的内容判断匿名级别, realIP 为本机出口 IP
+func classifyAnonymity(judge *JudgeResponse, realIP string) Anonymity {
+	if realIP == "" {
+		return AnonymityUnknown
+	}
+	if containsIP(judge.Origin, realIP) {
+		return AnonymityTransparent
+	}
+	for _, value := range judge.Headers {
+		if containsIP(value, realIP) {
+			return AnonymityTransparent
+		}
+	}
+	for key := range judge.Headers {
+		for _, header := range proxyHeaders {
+			if strings.EqualFold(key, header) {
+				return AnonymityAnonymous
+			}
+		}
+	}
+	return AnonymityElite
+}
+
+// containsIP 判断以逗号或空白分隔的列表中是否包含 ip
+func containsIP(list, ip string) bool {
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == ';' || r == '='
+	}) {
+		if strings.Trim(field, `"[]`) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// realIPCache 缓存本机不经代理访问 judge 时的出口 IP
+type realIPCache struct {
+	mu      sync.Mutex
+	ip      string
+	expires time.Time
+}
+
+func (c *realIPCache) get(fetch func() (string, error)) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ip != "" && time.Now().Before(c.expires) {
+		return c.ip
+	}
+	ip, err := fetch()
+	if err != nil {
+		return c.ip
+	}
+	c.ip = ip
+	c.expires = time.Now().Add(10 * time.Minute)
+	return c.ip
+}
+
+// readJudgeResponse 读取并解析 judge 返回的内容
+func readJudgeResponse(resp *http.Response) (*JudgeResponse, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("judge status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	judge := &JudgeResponse{}
+	if err := json.Unmarshal(body, judge); err != nil {
+		return nil, err
+	}
+	judge.Origin = strings.TrimSpace(judge.Origin)
+	return judge, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errLeaseNotFound 租约不存在或已过期
+var errLeaseNotFound = errors.New("lease not found")
+
+// Lease 代理租约, 有效期内该代理不会被再次租用
+type Lease struct {
+	ID      string     `json:"id"`
+	Proxy   *ProxyItem `json:"proxy"`
+	Expires time.Time  `json:"expires"`
+}
+
+func (pdb *ProxyDB) createLeaseTable() error {
+	_, err := pdb.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_leases (
+		id TEXT PRIMARY KEY,
+		ip TEXT NOT NULL,
+		expires INTEGER NOT NULL
+	)`, pdb.table))
+	if err != nil {
+		return err
+	}
+	_, err = pdb.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_leases_ip ON %s_leases (ip, expires)", pdb.table, pdb.table))
+	return err
+}
+
+// Lease 租用一个满足条件且没有被其他人租用的代理, 没有时返回 nil
+func (pdb *ProxyDB) Lease(filter ProxyFilter, ttl time.Duration) (*Lease, error) {
+	pdb.leaseMu.Lock()
+	defer pdb.leaseMu.Unlock()
+
+	now := time.Now()
+	_, err := pdb.db.Exec(fmt.Sprintf("DELETE FROM %s_leases WHERE expires <= ?", pdb.table), now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	filter.ExcludeLeased = true
+	proxy, err := pdb.GetBy(filter)
+	if err != nil || proxy == nil {
+		return nil, err
+	}
+
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{ID: id, Proxy: proxy, Expires: now.Add(ttl)}
+	_, err = pdb.db.Exec(fmt.Sprintf("INSERT INTO %s_leases (id, ip, expires) VALUES (?, ?, ?)", pdb.table), lease.ID, proxy.IP, lease.Expires.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Release 归还租约, 返回租用的代理 ip, 租约不存在或已过期时返回 errLeaseNotFound
+func (pdb *ProxyDB) Release(id string) (string, error) {
+	pdb.leaseMu.Lock()
+	defer pdb.leaseMu.Unlock()
+
+	var ip string
+	var expires int64
+	row := pdb.db.QueryRow(fmt.Sprintf("SELECT ip, expires FROM %s_leases WHERE id = ?", pdb.table), id)
+	if err := row.Scan(&ip, &expires); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errLeaseNotFound
+		}
+		return "", err
+	}
+
+	_, err := pdb.db.Exec(fmt.Sprintf("DELETE FROM %s_leases WHERE id = ?", pdb.table), id)
+	if err != nil {
+		return "", err
+	}
+	if expires <= time.Now().UnixNano() {
+		return "", errLeaseNotFound
+	}
+	return ip, nil
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
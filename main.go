@@ -4,13 +4,17 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 )
 
 type App struct {
 	Config    *Config
 	validator *ProxyValidator
 	fetcher   *ProxyFetcher
+	sources   []ProxySource
 	Database  *ProxyDB
+	pool      *VerifyPool
+	sessions  *SessionStore
 	logger    *log.Logger
 	Version   string
 }
@@ -23,11 +27,68 @@ func main() {
 
 	app.Version = "2.4.0"
 
+	var err error
 	app.Config, _ = NewConfig("config.toml")
-	app.Database, _ = NewProxyDB(app.Config.DBName, app.Config.TableName)
+	if err := SetCredentialKey(app.Config.CredentialKey); err != nil {
+		log.Fatalf("Failed to load CredentialKey: %s", err)
+	}
+	SetScoreHalfLife(time.Duration(app.Config.ScoreHalfLife) * time.Second)
+	app.Database, err = NewProxyDB(app.Config.DBName, app.Config.TableName)
+	if err != nil {
+		log.Fatalf("Failed to open database: %s", err)
+	}
 
 	app.fetcher, _ = NewProxyFetcher()
-	app.validator = NewProxyValidator(app.Config.HttpURL, app.Config.HttpsURL, app.Config.VerifyTimeout)
+	if err := RegisterConfigSources(app.fetcher, app.Config.Sources); err != nil {
+		log.Fatalf("Failed to load Sources: %s", err)
+	}
+	app.sources, err = LookupSources(app.Config.ProxyFetcher)
+	if err != nil {
+		log.Fatalf("Failed to load ProxyFetcher: %s", err)
+	}
+	if !ValidStrategy(app.Config.SelectStrategy) {
+		log.Fatalf("Unknown SelectStrategy: %s", app.Config.SelectStrategy)
+	}
+	app.validator = NewProxyValidator(app.Config.HttpURL, app.Config.HttpsURL, app.Config.JudgeURL, app.Config.VerifyTimeout)
+	app.validator.SetSpeedTestURL(app.Config.SpeedTestURL)
+	app.validator.SetVerifyTLS(app.Config.VerifyTLS)
+	rootCAs, err := LoadCertPool(app.Config.CAFile)
+	if err != nil {
+		log.Fatalf("Failed to load CAFile: %s", err)
+	}
+	pin, err := ParseFingerprint(app.Config.HttpsPin)
+	if err != nil {
+		log.Fatalf("Failed to load HttpsPin: %s", err)
+	}
+	app.validator.SetCertPool(rootCAs, pin)
+	httpCheck, err := NewContentCheck(app.Config.HttpCheck)
+	if err != nil {
+		log.Fatalf("Failed to load HttpCheck: %s", err)
+	}
+	httpsCheck, err := NewContentCheck(app.Config.HttpsCheck)
+	if err != nil {
+		log.Fatalf("Failed to load HttpsCheck: %s", err)
+	}
+	app.validator.SetContentChecks(httpCheck, httpsCheck)
+	profiles, err := NewProfiles(app.Config.Profiles)
+	if err != nil {
+		log.Fatalf("Failed to load Profiles: %s", err)
+	}
+	app.validator.SetProfiles(profiles)
+	if app.Config.ProxyRegion && app.Config.GeoBackend == "" {
+		// 旧版本保存的配置中 ProxyRegion 默认开启且没有 GeoBackend, 不再默认在线查询
+		log.Printf("ProxyRegion is enabled but GeoBackend is empty, region lookup disabled; set GeoBackend to mmdb, ip2region or http")
+		app.Config.ProxyRegion = false
+	}
+	if app.Config.ProxyRegion {
+		geo, err := NewGeoResolver(app.Config.GeoBackend, app.Config.GeoDBPath, app.Config.GeoASNDBPath, app.Config.GeoLanguage, app.Config.VerifyTimeout)
+		if err != nil {
+			log.Fatalf("Failed to load GeoBackend: %s", err)
+		}
+		app.validator.SetGeoResolver(geo)
+	}
+	app.pool = NewVerifyPool(app.Config.VerifyWorkers, app.Config.VerifyQueueSize)
+	app.sessions = NewSessionStore(time.Duration(app.Config.SessionTTL) * time.Second)
 
 	// 创建日志文件
 	fileName := "go_proxy_pool.log"
@@ -43,6 +104,8 @@ func main() {
 
 	go runScheduler()
 
+	go gatewayStart()
+
 	httpStart()
 
 }
@@ -55,5 +118,7 @@ func test() {
 
 	testProxyFetcher()
 
+	testHTMLSource()
+
 	testConfig()
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errBadCert 证书校验失败, 代理可能替换了证书
+var errBadCert = errors.New("invalid tls certificate")
+
+// certError 将证书校验失败的错误包装为 errBadCert, 其他错误原样返回
+func certError(err error) error {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return fmt.Errorf("%w: %s", errBadCert, err)
+	}
+	return err
+}
+
+// LoadCertPool 读取 PEM 格式的 CA 证书文件, path 为空时返回 nil 表示使用系统证书
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ParseFingerprint 解析 SHA256 证书指纹, 支持 openssl 输出的冒号分隔格式, 返回小写十六进制
+func ParseFingerprint(fingerprint string) (string, error) {
+	if fingerprint == "" {
+		return "", nil
+	}
+	normalized := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	if b, err := hex.DecodeString(normalized); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 fingerprint %s", fingerprint)
+	}
+	return normalized, nil
+}
+
+// checkPin 检查服务端证书的 SHA256 指纹, pin 为空时不检查
+func checkPin(state *tls.ConnectionState, pin string) error {
+	if pin == "" || state == nil {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no peer certificate", errBadCert)
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	if got := hex.EncodeToString(sum[:]); got != pin {
+		return fmt.Errorf("%w: fingerprint %s does not match", errBadCert, got)
+	}
+	return nil
+}
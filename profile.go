@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errBodyMismatch 响应内容不符合要求
+	errBodyMismatch = errors.New("response body mismatch")
+	// errTooSlow 总耗时超过 Profile 的限制
+	errTooSlow = errors.New("latency exceeds limit")
+
+	profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+// Profile 针对具体目标网站的验证配置, 在 http/https 验证通过后额外执行
+type Profile struct {
+	Name       string
+	URL        string
+	Method     string
+	Headers    map[string]string
+	Body       string
+	Status     []int
+	BodyRegex  *regexp.Regexp
+	MaxLatency time.Duration
+}
+
+// NewProfile 根据配置创建 Profile
+func NewProfile(cfg ProfileConfig) (*Profile, error) {
+	// 名称会出现在转发代理的用户名中, 不能包含 - 等分隔符
+	if !profileNamePattern.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("invalid profile name %q", cfg.Name)
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("profile %s: invalid url %s", cfg.Name, cfg.URL)
+	}
+	profile := &Profile{
+		Name:       cfg.Name,
+		URL:        cfg.URL,
+		Method:     strings.ToUpper(cfg.Method),
+		Headers:    cfg.Headers,
+		Body:       cfg.Body,
+		Status:     cfg.Status,
+		MaxLatency: time.Duration(cfg.MaxLatency) * time.Millisecond,
+	}
+	if profile.Method == "" {
+		profile.Method = http.MethodGet
+	}
+	if len(profile.Status) == 0 {
+		profile.Status = []int{http.StatusOK}
+	}
+	if cfg.BodyRegex != "" {
+		profile.BodyRegex, err = regexp.Compile(cfg.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", cfg.Name, err)
+		}
+	}
+	return profile, nil
+}
+
+// NewProfiles 根据配置创建所有 Profile, 名称不能重复
+func NewProfiles(cfgs []ProfileConfig) ([]*Profile, error) {
+	var profiles []*Profile
+	names := make(map[string]bool)
+	for _, cfg := range cfgs {
+		profile, err := NewProfile(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if names[profile.Name] {
+			return nil, fmt.Errorf("duplicate profile %s", profile.Name)
+		}
+		names[profile.Name] = true
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func (p *Profile) statusOK(code int) bool {
+	for _, status := range p.Status {
+		if status == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfileResult 单个 Profile 的验证结果
+type ProfileResult struct {
+	Name    string
+	Success bool
+	Latency int64 // 总耗时(毫秒)
+	Error   error
+}
+
+// ProfileValidator 通过代理按 profile 访问目标网站, 返回总耗时(毫秒)
+func (pv *ProxyValidator) ProfileValidator(proxy, protocol string, profile *Profile) (int64, error) {
+	client, err := pv.newClient(proxy, protocol)
+	if err != nil {
+		return 0, err
+	}
+	var body io.Reader
+	if profile.Body != "" {
+		body = strings.NewReader(profile.Body)
+	}
+	req, err := http.NewRequest(profile.Method, profile.URL, body)
+	if err != nil {
+		return 0, err
+	}
+	pv.setRequestHeaders(req)
+	for key, value := range profile.Headers {
+		req.Header.Set(key, value)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, certError(err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return 0, err
+	}
+	latency := sinceMillis(start)
+
+	if !profile.statusOK(resp.StatusCode) {
+		return latency, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if profile.BodyRegex != nil && !profile.BodyRegex.Match(content) {
+		return latency, errBodyMismatch
+	}
+	if profile.MaxLatency > 0 && time.Duration(latency)*time.Millisecond > profile.MaxLatency {
+		return latency, fmt.Errorf("%w: %dms > %dms", errTooSlow, latency, profile.MaxLatency.Milliseconds())
+	}
+	return latency, nil
+}
+
+// HasProfile 返回是否配置了名为 name 的 Profile
+func (pv *ProxyValidator) HasProfile(name string) bool {
+	for _, profile := range pv.profiles {
+		if profile.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyProfiles 并发执行所有 Profile
+func (pv *ProxyValidator) verifyProfiles(proxy, protocol string) []ProfileResult {
+	results := make([]ProfileResult, len(pv.profiles))
+	var wg sync.WaitGroup
+	for i, profile := range pv.profiles {
+		wg.Add(1)
+		go func(i int, profile *Profile) {
+			defer wg.Done()
+			latency, err := pv.ProfileValidator(proxy, protocol, profile)
+			results[i] = ProfileResult{Name: profile.Name, Success: err == nil, Latency: latency, Error: err}
+		}(i, profile)
+	}
+	wg.Wait()
+	return results
+}
+
+func (pdb *ProxyDB) createProfileTable() error {
+	_, err := pdb.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_profiles (
+		ip TEXT NOT NULL,
+		profile TEXT NOT NULL,
+		success INTEGER NOT NULL,
+		latency INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		PRIMARY KEY (ip, profile)
+	)`, pdb.table))
+	return err
+}
+
+// PutProfileResults 用最近一次验证的结果替换代理的 Profile 结果, results 为空时清除该代理的所有结果
+func (pdb *ProxyDB) PutProfileResults(ip string, results []ProfileResult) error {
+	tx, err := pdb.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s_profiles WHERE ip = ?", pdb.table), ip)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now().Unix()
+	for _, result := range results {
+		_, err := tx.Exec(fmt.Sprintf("INSERT INTO %s_profiles (ip, profile, success, latency, time) VALUES (?, ?, ?, ?, ?)", pdb.table),
+			ip, result.Name, result.Success, result.Latency, now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -2,27 +2,150 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// sqliteDriver 注册了 decay_score 函数的 sqlite3 驱动
+const sqliteDriver = "sqlite3_proxy_pool"
+
+// scoreColumn 衰减到当前时间的质量分, 排序和加权选择时代替 score 列
+const scoreColumn = "decay_score(score, success_weight, total_weight, score_time)"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("decay_score", decayedScore, false)
+		},
+	})
+}
+
 type ProxyItem struct {
-	IP         string `json:"ip"`
-	Type       int    `json:"type"`
-	Address    string `json:"address"`
-	CheckCount int    `json:"checkCount"`
-	FailCount  int    `json:"failCount"`
-	LastTime   string `json:"lastTime"`
-	LastStatus bool   `json:"lastStatus"`
+	IP         string     `json:"ip"` // host:port, 不包含认证信息
+	Scheme     string     `json:"scheme"`
+	Host       string     `json:"host"`
+	Port       int        `json:"port"`
+	Username   Credential `json:"username,omitempty"` // 只返回给携带 ApiToken 的调用方
+	Password   Credential `json:"password,omitempty"`
+	Type       int        `json:"type"`
+	Address    string     `json:"address"`
+	CheckCount int        `json:"checkCount"`
+	FailCount  int        `json:"failCount"`
+	LastTime   string     `json:"lastTime"`
+	LastStatus bool       `json:"lastStatus"`
+	Anonymity  Anonymity  `json:"anonymity"`
+	Latency    int64      `json:"latency"`    // 最快协议总耗时的滑动平均值(毫秒), 0 表示未测量
+	Throughput float64    `json:"throughput"` // 下载速度的滑动平均值(KB/s), 0 表示未测速
+	Latencies  Latencies  `json:"latencies"`  // 各协议耗时的滑动平均值
+	Score      float64    `json:"score"`      // 综合质量分 0~100, 见 UpdateScore
+	MITM       bool       `json:"mitm"`       // https 隧道中的证书未通过校验, 代理可能解密了流量
+	ExitIP     string     `json:"exitIp"`     // 目标网站看到的出口 IP, 多个代理可能共用同一出口
+	GeoInfo
+
+	// 按时间衰减的成功次数和总次数, 以及上次更新的时间(unix 秒)
+	SuccessWeight float64 `json:"-"`
+	TotalWeight   float64 `json:"-"`
+	ScoreTime     int64   `json:"-"`
+}
+
+// SetGeo 设置地理位置信息, 并同步更新 Address
+func (p *ProxyItem) SetGeo(geo *GeoInfo) {
+	p.GeoInfo = *geo
+	p.Address = geo.String()
+}
+
+// Latencies 各协议的耗时, 以 JSON 格式存储在数据库中
+type Latencies map[string]Latency
+
+func (l Latencies) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (l *Latencies) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into Latencies", src)
+	}
+	if len(data) == 0 {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(data, l)
+}
+
+// latencyAlpha 滑动平均中新样本的权重
+const latencyAlpha = 0.3
+
+func ewma(old, sample float64) float64 {
+	if old <= 0 {
+		return sample
+	}
+	return old*(1-latencyAlpha) + sample*latencyAlpha
+}
+
+// Apply 将验证结果合并到代理信息中, 耗时和速度取滑动平均值
+func (p *ProxyItem) Apply(result *VerifyResult) {
+	p.Type = result.Type
+	p.Scheme = proxyScheme(result.Type)
+	p.MITM = result.MITM
+	if result.ExitIP != "" {
+		p.ExitIP = result.ExitIP
+	}
+	if result.Anonymity != AnonymityUnknown {
+		p.Anonymity = result.Anonymity
+	}
+	if p.Latencies == nil {
+		p.Latencies = make(Latencies)
+	}
+	var fastest int64
+	for protocol, sample := range result.Latencies {
+		old := p.Latencies[protocol]
+		p.Latencies[protocol] = Latency{
+			Connect: int64(ewma(float64(old.Connect), float64(sample.Connect))),
+			TTFB:    int64(ewma(float64(old.TTFB), float64(sample.TTFB))),
+			Total:   int64(ewma(float64(old.Total), float64(sample.Total))),
+		}
+		if fastest == 0 || sample.Total < fastest {
+			fastest = sample.Total
+		}
+	}
+	if fastest > 0 {
+		p.Latency = int64(ewma(float64(p.Latency), float64(fastest)))
+	}
+	if result.Throughput > 0 {
+		p.Throughput = ewma(p.Throughput, result.Throughput)
+	}
 }
 
+// NewProxyItem 创建代理, ip 可以是 user:pass@host:port 格式, 认证信息单独保存
 func NewProxyItem(ip, address string, proxyType int) *ProxyItem {
-	return &ProxyItem{
-		IP:         ip,
+	proxy := &ProxyItem{
+		Scheme:     proxyScheme(proxyType),
 		Type:       proxyType,
 		Address:    address,
 		CheckCount: 1,
@@ -30,15 +153,203 @@ func NewProxyItem(ip, address string, proxyType int) *ProxyItem {
 		LastTime:   time.Now().Format("2006-01-02 15:04:05"),
 		LastStatus: true,
 	}
+	proxy.setAddr(ip)
+	proxy.Score = proxy.computeScore()
+	return proxy
+}
+
+// ProxyFilter 代理查询条件, 零值表示不过滤
+type ProxyFilter struct {
+	IP         string        // 指定代理
+	Type       int           // 需要支持的代理类型掩码
+	AnyType    int           // 至少支持其中一种的代理类型掩码
+	Anonymity  Anonymity     // 最低匿名级别
+	MaxLatency time.Duration // 最大耗时
+	Sort       string        // 排序方式: latency 耗时从低到高, throughput 速度从高到低
+	Strategy   string        // 获取单个代理时的选择策略, 为空时使用 random
+
+	Countries        []string // 国家代码, 满足其一即可
+	ExcludeCountries []string // 排除的国家代码
+	ISP              string   // 运营商, 模糊匹配
+	ASNs             []uint   // ASN, 满足其一即可
+	ExcludeIPs       []string // 排除的代理
+	ExcludeLeased    bool     // 排除租约未到期的代理
+	Profile          string   // 最近一次验证通过的 Profile
+	AllowMITM        bool     // 要求 https 时是否包含 MITM 代理, 默认排除
+	DistinctExit     bool     // 同一出口 IP 只保留质量分最高的代理, 出口未知的代理不去重
+	IPv6             *bool    // true 只要 IPv6 代理, false 排除 IPv6 代理, nil 不过滤
+}
+
+// where 返回查询条件语句和参数, table 为代理表名
+func (f ProxyFilter) where(table string) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.IP != "" {
+		conds = append(conds, "ip = ?")
+		args = append(args, f.IP)
+	}
+	if f.Type > 0 {
+		conds = append(conds, "(type & ?) = ?")
+		args = append(args, f.Type, f.Type)
+	}
+	if f.AnyType > 0 {
+		conds = append(conds, "(type & ?) != 0")
+		args = append(args, f.AnyType)
+	}
+	if f.IPv6 != nil {
+		// IPv6 代理以 [ipv6]:port 格式保存
+		if *f.IPv6 {
+			conds = append(conds, "instr(ip, '[') > 0")
+		} else {
+			conds = append(conds, "instr(ip, '[') = 0")
+		}
+	}
+	if (f.Type|f.AnyType)&ProxyTypeHTTPS != 0 && !f.AllowMITM {
+		conds = append(conds, "mitm = 0")
+	}
+	if f.Anonymity > AnonymityUnknown {
+		conds = append(conds, "anonymity >= ?")
+		args = append(args, int(f.Anonymity))
+	}
+	if f.MaxLatency > 0 {
+		conds = append(conds, "latency > 0 AND latency <= ?")
+		args = append(args, f.MaxLatency.Milliseconds())
+	}
+	if len(f.Countries) > 0 {
+		conds = append(conds, "country_code IN ("+placeholders(len(f.Countries))+")")
+		for _, country := range f.Countries {
+			args = append(args, strings.ToUpper(country))
+		}
+	}
+	if len(f.ExcludeCountries) > 0 {
+		conds = append(conds, "country_code NOT IN ("+placeholders(len(f.ExcludeCountries))+")")
+		for _, country := range f.ExcludeCountries {
+			args = append(args, strings.ToUpper(country))
+		}
+	}
+	if f.ISP != "" {
+		conds = append(conds, "isp LIKE ?")
+		args = append(args, "%"+f.ISP+"%")
+	}
+	if len(f.ASNs) > 0 {
+		conds = append(conds, "asn IN ("+placeholders(len(f.ASNs))+")")
+		for _, asn := range f.ASNs {
+			args = append(args, asn)
+		}
+	}
+	if len(f.ExcludeIPs) > 0 {
+		conds = append(conds, "ip NOT IN ("+placeholders(len(f.ExcludeIPs))+")")
+		for _, ip := range f.ExcludeIPs {
+			args = append(args, ip)
+		}
+	}
+	if f.ExcludeLeased {
+		conds = append(conds, fmt.Sprintf("ip NOT IN (SELECT ip FROM %s_leases WHERE expires > ?)", table))
+		args = append(args, time.Now().UnixNano())
+	}
+	if f.Profile != "" {
+		conds = append(conds, fmt.Sprintf("ip IN (SELECT ip FROM %s_profiles WHERE profile = ? AND success = 1)", table))
+		args = append(args, f.Profile)
+	}
+	if len(conds) == 0 && !f.DistinctExit {
+		return "", nil
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	if f.DistinctExit {
+		// 先按其它条件过滤, 再在每个出口中选出代表
+		where = fmt.Sprintf(` WHERE ip IN (
+			SELECT ip FROM (
+				SELECT ip, exit_ip, ROW_NUMBER() OVER (PARTITION BY exit_ip ORDER BY %s DESC, latency) AS rn FROM %s%s
+			) WHERE rn = 1 OR exit_ip = ''
+		)`, scoreColumn, table, where)
+	}
+	return where, args
+}
+
+// orderBy 返回排序语句
+func (f ProxyFilter) orderBy() string {
+	switch f.Sort {
+	case "latency", "speed":
+		return " ORDER BY latency = 0, latency"
+	case "throughput":
+		return " ORDER BY throughput DESC"
+	case "score":
+		return " ORDER BY " + scoreColumn + " DESC"
+	}
+	return " ORDER BY type,check_count,last_time DESC"
+}
+
+// placeholders 返回 n 个以逗号分隔的 ?
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// proxyColumns 查询和写入的列, 顺序与 scanProxy、proxyValues 一致
+const proxyColumns = "ip, address, type, check_count, fail_count, last_time, last_status, anonymity, latency, throughput, latencies, " +
+	"country_code, country, region, city, isp, asn, score, success_weight, total_weight, score_time, mitm, exit_ip, " +
+	"scheme, host, port, username, password"
+
+func proxyValues(proxy *ProxyItem) []interface{} {
+	return []interface{}{proxy.IP, proxy.Address, proxy.Type, proxy.CheckCount, proxy.FailCount, proxy.LastTime, proxy.LastStatus, proxy.Anonymity, proxy.Latency, proxy.Throughput, proxy.Latencies,
+		proxy.CountryCode, proxy.Country, proxy.Region, proxy.City, proxy.ISP, proxy.ASN, proxy.Score, proxy.SuccessWeight, proxy.TotalWeight, proxy.ScoreTime, proxy.MITM, proxy.ExitIP,
+		proxy.Scheme, proxy.Host, proxy.Port, proxy.Username, proxy.Password}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProxy(row rowScanner) (*ProxyItem, error) {
+	proxy := &ProxyItem{}
+	err := row.Scan(&proxy.IP, &proxy.Address, &proxy.Type, &proxy.CheckCount, &proxy.FailCount, &proxy.LastTime, &proxy.LastStatus, &proxy.Anonymity, &proxy.Latency, &proxy.Throughput, &proxy.Latencies,
+		&proxy.CountryCode, &proxy.Country, &proxy.Region, &proxy.City, &proxy.ISP, &proxy.ASN, &proxy.Score, &proxy.SuccessWeight, &proxy.TotalWeight, &proxy.ScoreTime, &proxy.MITM, &proxy.ExitIP,
+		&proxy.Scheme, &proxy.Host, &proxy.Port, &proxy.Username, &proxy.Password)
+	if err != nil {
+		return nil, err
+	}
+	proxy.decay(decayHalfLife, time.Now().Unix())
+	return proxy, nil
+}
+
+// 代理选择策略
+const (
+	StrategyRandom     = "random"      // 均匀随机
+	StrategyWeighted   = "weighted"    // 按质量分加权随机
+	StrategyLRU        = "lru"         // 最久未被获取
+	StrategyRoundRobin = "round_robin" // 按 ip 顺序轮询
+	StrategyLatency    = "latency"     // 延迟最低
+	StrategyScore      = "score"       // 质量分最高
+)
+
+// ValidStrategy 判断选择策略是否合法, 空字符串表示默认策略
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case "", StrategyRandom, StrategyWeighted, StrategyLRU, StrategyRoundRobin, StrategyLatency, StrategyScore:
+		return true
+	}
+	return false
 }
 
 type ProxyDB struct {
 	db    *sql.DB
 	table string
+
+	// round_robin 策略上一次返回的 ip
+	cursorMu sync.Mutex
+	cursor   string
+
+	// 保证租用时选择和登记是原子的
+	leaseMu sync.Mutex
+
+	// 保证 Modify 的读取和写回是原子的
+	modifyMu sync.Mutex
 }
 
 func NewProxyDB(dbPath, tableName string) (*ProxyDB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open(sqliteDriver, dbPath)
 	if err != nil {
 		return nil, err
 	}
@@ -56,10 +367,190 @@ func NewProxyDB(dbPath, tableName string) (*ProxyDB, error) {
 		return nil, err
 	}
 
-	return &ProxyDB{
+	pdb := &ProxyDB{
 		db:    db,
 		table: tableName,
-	}, nil
+	}
+
+	// 新建和旧版本数据库统一补充新增的列
+	err = pdb.addColumns(proxyAddedColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pdb.createLeaseTable()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pdb.createReportTable()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pdb.createCheckTable()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pdb.createProfileTable()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pdb.migrateAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	err = pdb.migrateScores()
+	if err != nil {
+		return nil, err
+	}
+
+	return pdb, nil
+}
+
+// proxyAddedColumns 初始表结构之后新增的列
+var proxyAddedColumns = [][2]string{
+	{"anonymity", "INTEGER NOT NULL DEFAULT 0"},
+	{"latency", "INTEGER NOT NULL DEFAULT 0"},
+	{"throughput", "REAL NOT NULL DEFAULT 0"},
+	{"latencies", "TEXT NOT NULL DEFAULT ''"},
+	{"country_code", "TEXT NOT NULL DEFAULT ''"},
+	{"country", "TEXT NOT NULL DEFAULT ''"},
+	{"region", "TEXT NOT NULL DEFAULT ''"},
+	{"city", "TEXT NOT NULL DEFAULT ''"},
+	{"isp", "TEXT NOT NULL DEFAULT ''"},
+	{"asn", "INTEGER NOT NULL DEFAULT 0"},
+	{"score", "REAL NOT NULL DEFAULT 50"},
+	{"last_served", "INTEGER NOT NULL DEFAULT 0"},
+	{"success_weight", "REAL NOT NULL DEFAULT 0"},
+	{"total_weight", "REAL NOT NULL DEFAULT 0"},
+	{"score_time", "INTEGER NOT NULL DEFAULT 0"},
+	{"mitm", "INTEGER NOT NULL DEFAULT 0"},
+	{"exit_ip", "TEXT NOT NULL DEFAULT ''"},
+	{"scheme", "TEXT NOT NULL DEFAULT ''"},
+	{"host", "TEXT NOT NULL DEFAULT ''"},
+	{"port", "INTEGER NOT NULL DEFAULT 0"},
+	{"username", "TEXT NOT NULL DEFAULT ''"},
+	{"password", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrateScores 为旧版本没有质量分记录的代理按检测次数和失败次数补充质量分,
+// 避免升级后的旧代理都是满分而排在新代理前面
+func (pdb *ProxyDB) migrateScores() error {
+	proxies, err := pdb.queryProxies(fmt.Sprintf("SELECT %s FROM %s WHERE score_time = 0", proxyColumns, pdb.table))
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, proxy := range proxies {
+		proxy.TotalWeight = float64(proxy.CheckCount)
+		proxy.SuccessWeight = math.Max(float64(proxy.CheckCount-proxy.FailCount), 0)
+		proxy.ScoreTime = now
+		proxy.Score = proxy.computeScore()
+		// 以最后一次检测的时间作为记录时间, 读取时按经过的时间衰减
+		if last, err := time.ParseInLocation("2006-01-02 15:04:05", proxy.LastTime, time.Local); err == nil && last.Unix() < now {
+			proxy.ScoreTime = last.Unix()
+		}
+		if err := pdb.Update(proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAddrs 为旧版本数据补充 scheme、host、port, 并把保存在 ip 中的认证信息拆分到单独的列,
+// 同时把 :080 这类未规范化的端口改为规范写法
+func (pdb *ProxyDB) migrateAddrs() error {
+	rows, err := pdb.db.Query(fmt.Sprintf("SELECT ip, type, host FROM %s", pdb.table))
+	if err != nil {
+		return err
+	}
+	var items []*ProxyItem
+	for rows.Next() {
+		item := &ProxyItem{}
+		if err := rows.Scan(&item.IP, &item.Type, &item.Host); err != nil {
+			rows.Close()
+			return err
+		}
+		// 已拆分过的记录 ip 中不含认证信息, 只需要处理未规范化的地址
+		if item.Host == "" || proxyKey(item.IP) != item.IP {
+			items = append(items, item)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		old := item.IP
+		migrated := item.Host != ""
+		item.setAddr(old)
+		if item.IP != old && pdb.Exists(item.IP) {
+			// 同一个代理已经以新格式保存, 删除旧记录
+			if err := pdb.Delete(old); err != nil {
+				return err
+			}
+			continue
+		}
+		if migrated {
+			_, err = pdb.db.Exec(fmt.Sprintf("UPDATE %s SET ip = ?, host = ?, port = ? WHERE ip = ?", pdb.table),
+				item.IP, item.Host, item.Port, old)
+		} else {
+			_, err = pdb.db.Exec(fmt.Sprintf("UPDATE %s SET ip = ?, scheme = ?, host = ?, port = ?, username = ?, password = ? WHERE ip = ?", pdb.table),
+				item.IP, proxyScheme(item.Type), item.Host, item.Port, item.Username, item.Password, old)
+		}
+		if err != nil {
+			return err
+		}
+		if item.IP == old {
+			continue
+		}
+		for _, table := range []string{"checks", "reports", "profiles"} {
+			_, err := pdb.db.Exec(fmt.Sprintf("UPDATE OR REPLACE %s_%s SET ip = ? WHERE ip = ?", pdb.table, table), item.IP, old)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addColumns 为表补充缺失的列, columns 为列名和列定义
+func (pdb *ProxyDB) addColumns(columns [][2]string) error {
+	rows, err := pdb.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", pdb.table))
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		if existing[column[0]] {
+			continue
+		}
+		_, err := pdb.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", pdb.table, column[0], column[1]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (pdb *ProxyDB) Close() {
@@ -67,36 +558,102 @@ func (pdb *ProxyDB) Close() {
 }
 
 func (pdb *ProxyDB) Get() (*ProxyItem, error) {
-	row := pdb.db.QueryRow(fmt.Sprintf("SELECT ip, address, type, check_count, fail_count, last_time, last_status FROM %s LIMIT 1", pdb.table))
+	return pdb.GetBy(ProxyFilter{})
+}
 
-	proxy := &ProxyItem{}
-	err := row.Scan(&proxy.IP, &proxy.Address, &proxy.Type, &proxy.CheckCount, &proxy.FailCount, &proxy.LastTime, &proxy.LastStatus)
+func (pdb *ProxyDB) GetType(proxyType int) (*ProxyItem, error) {
+	return pdb.GetBy(ProxyFilter{Type: proxyType})
+}
+
+// GetBy 按 filter.Strategy 选择一个满足条件的代理, 没有时返回 nil
+func (pdb *ProxyDB) GetBy(filter ProxyFilter) (*ProxyItem, error) {
+	where, args := filter.where(pdb.table)
+	var query string
+	switch filter.Strategy {
+	case "", StrategyRandom:
+		query = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY RANDOM() LIMIT 1", proxyColumns, pdb.table, where)
+	case StrategyWeighted:
+		// 按 ip 顺序累加质量分, 取累计值首个达到 随机数*总分 的代理
+		query = fmt.Sprintf(`SELECT %s FROM (
+			SELECT *, SUM(%s) OVER (ORDER BY ip ROWS UNBOUNDED PRECEDING) AS cum_score, SUM(%s) OVER () AS total_score
+			FROM %s%s
+		) WHERE cum_score >= ? * total_score ORDER BY cum_score, ip LIMIT 1`, proxyColumns, scoreColumn, scoreColumn, pdb.table, where)
+		args = append(args, rand.Float64())
+	case StrategyLRU:
+		query = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY last_served, RANDOM() LIMIT 1", proxyColumns, pdb.table, where)
+	case StrategyRoundRobin:
+		return pdb.getRoundRobin(filter)
+	case StrategyLatency:
+		query = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY latency = 0, latency LIMIT 1", proxyColumns, pdb.table, where)
+	case StrategyScore:
+		query = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s DESC, last_served LIMIT 1", proxyColumns, pdb.table, where, scoreColumn)
+	default:
+		return nil, fmt.Errorf("unknown strategy %s", filter.Strategy)
+	}
+
+	return pdb.getOne(query, args...)
+}
+
+func (pdb *ProxyDB) getRoundRobin(filter ProxyFilter) (*ProxyItem, error) {
+	pdb.cursorMu.Lock()
+	defer pdb.cursorMu.Unlock()
+
+	where, args := filter.where(pdb.table)
+	next := " WHERE ip > ?"
+	if where != "" {
+		next = where + " AND ip > ?"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY ip LIMIT 1", proxyColumns, pdb.table, next)
+	proxy, err := pdb.getOne(query, append(args, pdb.cursor)...)
+	if err == nil && proxy == nil && pdb.cursor != "" {
+		// 已经到末尾, 从头开始
+		query = fmt.Sprintf("SELECT %s FROM %s%s ORDER BY ip LIMIT 1", proxyColumns, pdb.table, where)
+		proxy, err = pdb.getOne(query, args...)
+	}
+	if proxy != nil {
+		pdb.cursor = proxy.IP
+	}
+	return proxy, err
+}
+
+// GetByIP 获取指定代理, 不记录获取时间, 不存在时返回 nil
+func (pdb *ProxyDB) GetByIP(ip string) (*ProxyItem, error) {
+	proxy, err := scanProxy(pdb.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE ip = ?", proxyColumns, pdb.table), ip))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-
 	return proxy, nil
 }
 
-func (pdb *ProxyDB) GetType(proxyType int) (*ProxyItem, error) {
-	row := pdb.db.QueryRow(fmt.Sprintf("SELECT ip, address, type, check_count, fail_count, last_time, last_status FROM %s WHERE (type & ?) = ?", pdb.table), proxyType, proxyType)
-
-	proxy := &ProxyItem{}
-	err := row.Scan(&proxy.IP, &proxy.Address, &proxy.Type, &proxy.CheckCount, &proxy.FailCount, &proxy.LastTime, &proxy.LastStatus)
+// getOne 查询一个代理并记录获取时间
+func (pdb *ProxyDB) getOne(query string, args ...interface{}) (*ProxyItem, error) {
+	proxy, err := scanProxy(pdb.db.QueryRow(query, args...))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
+
+	_, err = pdb.db.Exec(fmt.Sprintf("UPDATE %s SET last_served = ? WHERE ip = ?", pdb.table), time.Now().UnixNano(), proxy.IP)
+	if err != nil {
+		return nil, err
+	}
 	return proxy, nil
 }
 
+// Put 写入代理, 已存在时更新 proxyColumns 中的列, 其它列保持不变
 func (pdb *ProxyDB) Put(proxy *ProxyItem) error {
-	_, err := pdb.db.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s (ip, address, type, check_count, fail_count, last_time, last_status) VALUES (?, ?, ?, ?, ?, ?, ?)", pdb.table), proxy.IP, proxy.Address, proxy.Type, proxy.CheckCount, proxy.FailCount, proxy.LastTime, proxy.LastStatus)
+	values := proxyValues(proxy)
+	columns := strings.Split(proxyColumns, ", ")
+	updates := make([]string, 0, len(columns))
+	for _, column := range columns[1:] {
+		updates = append(updates, column+" = excluded."+column)
+	}
+	_, err := pdb.db.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT(ip) DO UPDATE SET %s", pdb.table, proxyColumns, placeholders(len(values)), strings.Join(updates, ", ")), values...)
 	if err != nil {
 		return err
 	}
@@ -104,12 +661,44 @@ func (pdb *ProxyDB) Put(proxy *ProxyItem) error {
 	return nil
 }
 
+// Update 更新已存在的代理, 代理已被删除时不做任何修改, 避免把删除的代理重新写入
+func (pdb *ProxyDB) Update(proxy *ProxyItem) error {
+	values := proxyValues(proxy)
+	columns := strings.Split(proxyColumns, ", ")
+	updates := make([]string, 0, len(columns))
+	for _, column := range columns[1:] {
+		updates = append(updates, column+" = ?")
+	}
+	_, err := pdb.db.Exec(fmt.Sprintf("UPDATE %s SET %s WHERE ip = ?", pdb.table, strings.Join(updates, ", ")), append(values[1:], proxy.IP)...)
+	return err
+}
+
+// Modify 重新读取代理并调用 fn 修改后写回, fn 返回 true 时删除代理, 代理不存在时不调用 fn.
+// 同一个 ProxyDB 上的 Modify 依次执行, 避免检测、转发、上报等并发的修改互相覆盖
+func (pdb *ProxyDB) Modify(ip string, fn func(proxy *ProxyItem) (remove bool)) error {
+	pdb.modifyMu.Lock()
+	defer pdb.modifyMu.Unlock()
+	proxy, err := pdb.GetByIP(ip)
+	if err != nil || proxy == nil {
+		return err
+	}
+	if fn(proxy) {
+		return pdb.Delete(ip)
+	}
+	return pdb.Update(proxy)
+}
+
 func (pdb *ProxyDB) Delete(ip string) error {
 	_, err := pdb.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE ip = ?", pdb.table), ip)
 	if err != nil {
 		return err
 	}
 
+	_, err = pdb.db.Exec(fmt.Sprintf("DELETE FROM %s_profiles WHERE ip = ?", pdb.table), ip)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -126,34 +715,33 @@ func (pdb *ProxyDB) Exists(ip string) bool {
 }
 
 func (pdb *ProxyDB) GetAll() ([]*ProxyItem, error) {
-	rows, err := pdb.db.Query(fmt.Sprintf("SELECT ip, address, type, check_count, fail_count, last_time, last_status FROM %s ORDER BY type,check_count,last_time DESC", pdb.table))
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return pdb.GetAllBy(ProxyFilter{})
+}
 
-	var proxies []*ProxyItem
-	for rows.Next() {
-		proxy := &ProxyItem{}
-		err := rows.Scan(&proxy.IP, &proxy.Address, &proxy.Type, &proxy.CheckCount, &proxy.FailCount, &proxy.LastTime, &proxy.LastStatus)
-		if err != nil {
-			log.Printf("Error scanning proxy data: %s\n", err)
-			continue
-		}
+func (pdb *ProxyDB) GetAllType(proxyType int) ([]*ProxyItem, error) {
+	return pdb.GetAllBy(ProxyFilter{Type: proxyType})
+}
 
-		proxies = append(proxies, proxy)
-	}
+// GetAllBy 获取所有满足条件的代理
+func (pdb *ProxyDB) GetAllBy(filter ProxyFilter) ([]*ProxyItem, error) {
+	where, args := filter.where(pdb.table)
+	return pdb.queryProxies(fmt.Sprintf("SELECT %s FROM %s%s%s", proxyColumns, pdb.table, where, filter.orderBy()), args...)
+}
 
-	err = rows.Err()
-	if err != nil {
-		return nil, err
-	}
+// CountExits 返回出口 IP 已知的不同出口数量
+func (pdb *ProxyDB) CountExits() (int, error) {
+	var count int
+	err := pdb.db.QueryRow(fmt.Sprintf("SELECT COUNT(DISTINCT exit_ip) FROM %s WHERE exit_ip != ''", pdb.table)).Scan(&count)
+	return count, err
+}
 
-	return proxies, nil
+// GetMissingLocation 获取没有结构化地理位置信息的代理, 用于旧版本数据升级
+func (pdb *ProxyDB) GetMissingLocation() ([]*ProxyItem, error) {
+	return pdb.queryProxies(fmt.Sprintf("SELECT %s FROM %s WHERE country_code = '' AND country = ''", proxyColumns, pdb.table))
 }
 
-func (pdb *ProxyDB) GetAllType(proxyType int) ([]*ProxyItem, error) {
-	rows, err := pdb.db.Query(fmt.Sprintf("SELECT ip, address, type, check_count, fail_count, last_time, last_status FROM %s WHERE (type & ?) = ? ORDER BY type,check_count,last_time DESC", pdb.table), proxyType, proxyType)
+func (pdb *ProxyDB) queryProxies(query string, args ...interface{}) ([]*ProxyItem, error) {
+	rows, err := pdb.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -161,8 +749,7 @@ func (pdb *ProxyDB) GetAllType(proxyType int) ([]*ProxyItem, error) {
 
 	var proxies []*ProxyItem
 	for rows.Next() {
-		proxy := &ProxyItem{}
-		err := rows.Scan(&proxy.IP, &proxy.Address, &proxy.Type, &proxy.CheckCount, &proxy.FailCount, &proxy.LastTime, &proxy.LastStatus)
+		proxy, err := scanProxy(rows)
 		if err != nil {
 			log.Printf("Error scanning proxy data: %s\n", err)
 			continue
@@ -180,18 +767,17 @@ func (pdb *ProxyDB) GetAllType(proxyType int) ([]*ProxyItem, error) {
 }
 
 func (pdb *ProxyDB) Pop() (*ProxyItem, error) {
-	row := pdb.db.QueryRow(fmt.Sprintf("SELECT ip, address, type, check_count, fail_count, last_time, last_status FROM %s LIMIT 1", pdb.table))
+	return pdb.PopBy(ProxyFilter{})
+}
 
-	proxy := &ProxyItem{}
-	err := row.Scan(&proxy.IP, &proxy.Address, &proxy.Type, &proxy.CheckCount, &proxy.FailCount, &proxy.LastTime, &proxy.LastStatus)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
+// PopBy 获取并删除一个满足条件的代理, 没有时返回 nil
+func (pdb *ProxyDB) PopBy(filter ProxyFilter) (*ProxyItem, error) {
+	proxy, err := pdb.GetBy(filter)
+	if err != nil || proxy == nil {
 		return nil, err
 	}
 
-	_, err = pdb.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE ip = ?", pdb.table), proxy.IP)
+	err = pdb.Delete(proxy.IP)
 	if err != nil {
 		return nil, err
 	}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
-	"reflect"
 	"regexp"
 	"strings"
 	"sync"
@@ -24,6 +26,21 @@ func NewProxyFetcher() (*ProxyFetcher, error) {
 	return &ProxyFetcher{}, nil
 }
 
+func init() {
+	pf := &ProxyFetcher{}
+	RegisterSource(NewSourceFunc("FreeProxy01", pf.FreeProxy01))
+	RegisterSource(NewSourceFunc("FreeProxy02", pf.FreeProxy02))
+	RegisterSource(NewSourceFunc("FreeProxy03", pf.FreeProxy03))
+	RegisterSource(NewSourceFunc("FreeProxy04", pf.FreeProxy04))
+	RegisterSource(NewSourceFunc("FreeProxy05", pf.FreeProxy05))
+	RegisterSource(NewSourceFunc("FreeProxy06", pf.FreeProxy06))
+	RegisterSource(NewSourceFunc("FreeProxy07", pf.FreeProxy07))
+	RegisterSource(NewSourceFunc("FreeProxy08", pf.FreeProxy08))
+	RegisterSource(NewSourceFunc("FreeProxy09", pf.FreeProxy09))
+	RegisterSource(NewSourceFunc("FreeProxy10", pf.FreeProxy10))
+	RegisterSource(NewSourceFunc("FreeProxy11", pf.FreeProxy11))
+}
+
 func (pf *ProxyFetcher) Header() http.Header {
 	headers := http.Header{}
 	headers.Set("User-Agent", pf.getUserAgent())
@@ -48,8 +65,42 @@ func (pf *ProxyFetcher) getUserAgent() string {
 	return uaList[rand.Intn(len(uaList))]
 }
 
-func (pf *ProxyFetcher) Get(url string, verify bool) (*goquery.Document, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func (pf *ProxyFetcher) Get(ctx context.Context, url string, verify bool) (*goquery.Document, error) {
+	resp, err := pf.do(ctx, url, verify)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// 使用 goquery 解析 HTML
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		log.Printf("Get %s", err)
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// GetBody 请求 url 并返回原始响应内容
+func (pf *ProxyFetcher) GetBody(ctx context.Context, url string, verify bool) ([]byte, error) {
+	resp, err := pf.do(ctx, url, verify)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Get %s", err)
+		return nil, err
+	}
+
+	return body, nil
+}
+
+func (pf *ProxyFetcher) do(ctx context.Context, url string, verify bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		log.Printf("Get %s", err)
 		return nil, err
@@ -69,29 +120,22 @@ func (pf *ProxyFetcher) Get(url string, verify bool) (*goquery.Document, error)
 		log.Printf("Get %s", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		log.Printf("Get status code error: %d %s", resp.StatusCode, resp.Status)
 		return nil, fmt.Errorf("Get status code error: %d %s", resp.StatusCode, resp.Status)
 	}
 
-	// 使用 goquery 解析 HTML
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
-	if err != nil {
-		log.Printf("Get %s", err)
-		return nil, err
-	}
-
-	return doc, nil
+	return resp, nil
 }
 
-func (pf *ProxyFetcher) FreeProxy01(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy01(ctx context.Context, proxyChan chan<- Candidate) error {
 	startURL := "https://www.zdaye.com/dayProxy.html"
-	doc, err := pf.Get(startURL, false)
+	doc, err := pf.Get(ctx, startURL, false)
 	if err != nil {
 		log.Printf("Failed to parse %s: %s", startURL, err)
-		return
+		return err
 	}
 
 	latestPageTime := doc.Find("span.thread_time_info").First().Text()
@@ -99,27 +143,31 @@ func (pf *ProxyFetcher) FreeProxy01(proxyChan chan<- string) {
 	latestPageTimeParsed, err := time.Parse(layout, strings.TrimSpace(latestPageTime))
 	if err != nil {
 		log.Printf("Failed to parse latest_page_time: %s", err)
-		return
+		return err
 	}
 
 	interval := time.Since(latestPageTimeParsed)
 	if interval.Seconds() < 300 {
 		targetURL := "https://www.zdaye.com/" + doc.Find("h3.thread_title a").First().AttrOr("href", "")
 		for targetURL != "" {
-			doc, err := pf.Get(targetURL, false)
+			doc, err := pf.Get(ctx, targetURL, false)
 			if err != nil {
 				log.Printf("Failed to parse %s: %s", targetURL, err)
-				break
+				return err
 			}
 
-			doc.Find("table tr").Each(func(i int, s *goquery.Selection) {
-				if i > 0 {
-					ip := strings.TrimSpace(s.Find("td:nth-child(1)").Text())
-					port := strings.TrimSpace(s.Find("td:nth-child(2)").Text())
-					proxyChan <- fmt.Sprintf("%s:%s", ip, port)
-					log.Printf("FreeProxy01 get proxy %s:%s", ip, port)
+			err = eachRow(doc.Find("table tr"), func(i int, s *goquery.Selection) error {
+				if i == 0 {
+					return nil
 				}
+				ip := strings.TrimSpace(s.Find("td:nth-child(1)").Text())
+				port := strings.TrimSpace(s.Find("td:nth-child(2)").Text())
+				log.Printf("FreeProxy01 get proxy %s:%s", ip, port)
+				return sendCandidate(ctx, proxyChan, Candidate{Proxy: fmt.Sprintf("%s:%s", ip, port), Source: "FreeProxy01"})
 			})
+			if err != nil {
+				return err
+			}
 
 			nextPage := doc.Find("div.page a[title='下一页']").AttrOr("href", "")
 			if nextPage == "" {
@@ -127,75 +175,89 @@ func (pf *ProxyFetcher) FreeProxy01(proxyChan chan<- string) {
 			}
 			targetURL = "https://www.zdaye.com/" + nextPage
 			// Sleep for 5 seconds before making the next request
-			time.Sleep(5 * time.Second)
+			if err := sleepContext(ctx, 5*time.Second); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
-func (pf *ProxyFetcher) FreeProxy02(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy02(ctx context.Context, proxyChan chan<- Candidate) error {
 	url := "http://www.66ip.cn/"
-	doc, err := pf.Get(url, false)
+	doc, err := pf.Get(ctx, url, false)
 	if err != nil {
 		log.Printf("Failed to parse %s: %s", url, err)
-		return
+		return err
 	}
 
-	doc.Find("table:nth-child(3) tr").Each(func(i int, s *goquery.Selection) {
-		if i > 0 {
-			ip := strings.TrimSpace(s.Find("td:nth-child(1)").Text())
-			port := strings.TrimSpace(s.Find("td:nth-child(2)").Text())
-			proxyChan <- fmt.Sprintf("%s:%s", ip, port)
-			log.Printf("FreeProxy02 get proxy %s:%s", ip, port)
+	return eachRow(doc.Find("table:nth-child(3) tr"), func(i int, s *goquery.Selection) error {
+		if i == 0 {
+			return nil
 		}
+		ip := strings.TrimSpace(s.Find("td:nth-child(1)").Text())
+		port := strings.TrimSpace(s.Find("td:nth-child(2)").Text())
+		log.Printf("FreeProxy02 get proxy %s:%s", ip, port)
+		return sendCandidate(ctx, proxyChan, Candidate{Proxy: fmt.Sprintf("%s:%s", ip, port), Source: "FreeProxy02"})
 	})
 }
 
-func (pf *ProxyFetcher) FreeProxy03(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy03(ctx context.Context, proxyChan chan<- Candidate) error {
 	targetURLs := []string{"http://www.kxdaili.com/dailiip.html", "http://www.kxdaili.com/dailiip/2/1.html"}
 	for i := 2; i <= 10; i++ {
 		targetURLs = append(targetURLs, fmt.Sprintf("http://www.kxdaili.com/dailiip/%d/1.html", i))
 		targetURLs = append(targetURLs, fmt.Sprintf("http://www.kxdaili.com/dailiip/2/%d.html", i))
 	}
+	var errs []error
 	for _, url := range targetURLs {
-		doc, err := pf.Get(url, false)
+		doc, err := pf.Get(ctx, url, false)
 		if err != nil {
 			log.Printf("Failed to parse %s: %s", url, err)
+			errs = append(errs, err)
 			continue
 		}
 
-		doc.Find("table.active tr").Each(func(i int, s *goquery.Selection) {
-			if i > 0 {
-				ip := strings.TrimSpace(s.Find("td:nth-child(1)").Text())
-				port := strings.TrimSpace(s.Find("td:nth-child(2)").Text())
-				proxyChan <- fmt.Sprintf("%s:%s", ip, port)
-				log.Printf("FreeProxy03 get proxy %s:%s", ip, port)
+		err = eachRow(doc.Find("table.active tr"), func(i int, s *goquery.Selection) error {
+			if i == 0 {
+				return nil
 			}
+			ip := strings.TrimSpace(s.Find("td:nth-child(1)").Text())
+			port := strings.TrimSpace(s.Find("td:nth-child(2)").Text())
+			log.Printf("FreeProxy03 get proxy %s:%s", ip, port)
+			return sendCandidate(ctx, proxyChan, Candidate{Proxy: fmt.Sprintf("%s:%s", ip, port), Source: "FreeProxy03"})
 		})
-		time.Sleep(5 * time.Second)
+		if err != nil {
+			return err
+		}
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return err
+		}
 	}
+	return errors.Join(errs...)
 }
 
-func (pf *ProxyFetcher) FreeProxy04(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy04(ctx context.Context, proxyChan chan<- Candidate) error {
 	url := "https://www.freeproxylists.net/zh/?c=CN&pt=&pr=&a%5B%5D=0&a%5B%5D=1&a%5B%5D=2&u=50"
-	doc, err := pf.Get(url, false)
+	doc, err := pf.Get(ctx, url, false)
 	if err != nil {
 		log.Printf("Failed to parse %s: %s", url, err)
-		return
+		return err
 	}
 
 	re := regexp.MustCompile(`(?i)\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}`)
-	doc.Find("tr.Odd, tr.Even").Each(func(i int, s *goquery.Selection) {
+	return eachRow(doc.Find("tr.Odd, tr.Even"), func(i int, s *goquery.Selection) error {
 		ipScript := strings.TrimSpace(s.Find("td:nth-child(1) script").Text())
 		ip := re.FindStringSubmatch(ipScript)
 		port := strings.TrimSpace(s.Find("td:nth-child(2)").Text())
-		if len(ip) > 0 {
-			proxyChan <- fmt.Sprintf("%s:%s", ip[0], port)
-			log.Printf("FreeProxy04 get proxy %s:%s", ip[0], port)
+		if len(ip) == 0 {
+			return nil
 		}
+		log.Printf("FreeProxy04 get proxy %s:%s", ip[0], port)
+		return sendCandidate(ctx, proxyChan, Candidate{Proxy: fmt.Sprintf("%s:%s", ip[0], port), Source: "FreeProxy04"})
 	})
 }
 
-func (pf *ProxyFetcher) FreeProxy05(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy05(ctx context.Context, proxyChan chan<- Candidate) error {
 	pageCount := 10
 	urlPattern := []string{
 		"https://www.kuaidaili.com/free/inha/%d/",
@@ -208,221 +270,254 @@ func (pf *ProxyFetcher) FreeProxy05(proxyChan chan<- string) {
 		}
 	}
 
+	var errs []error
 	for _, url := range urlList {
-		time.Sleep(1 * time.Second) // Sleep for 1 second
-		doc, err := pf.Get(url, false)
+		// Sleep for 1 second
+		if err := sleepContext(ctx, 1*time.Second); err != nil {
+			return err
+		}
+		doc, err := pf.Get(ctx, url, false)
 		if err != nil {
 			log.Printf("Failed to create document from response: %v", err)
+			errs = append(errs, err)
 			continue
 		}
 
-		doc.Find("table tr").Each(func(i int, s *goquery.Selection) {
-			if i > 0 {
-				ip := s.Find("td").Eq(0).Text()
-				port := s.Find("td").Eq(1).Text()
-				proxy := ip + ":" + port
-				proxyChan <- proxy
+		err = eachRow(doc.Find("table tr"), func(i int, s *goquery.Selection) error {
+			if i == 0 {
+				return nil
 			}
+			ip := s.Find("td").Eq(0).Text()
+			port := s.Find("td").Eq(1).Text()
+			proxy := ip + ":" + port
+			return sendCandidate(ctx, proxyChan, Candidate{Proxy: proxy, Source: "FreeProxy05"})
 		})
+		if err != nil {
+			return err
+		}
 
-		time.Sleep(5 * time.Second)
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return err
+		}
 	}
+	return errors.Join(errs...)
 }
 
-func (pf *ProxyFetcher) FreeProxy06(proxyChan chan<- string) error {
+func (pf *ProxyFetcher) FreeProxy06(ctx context.Context, proxyChan chan<- Candidate) error {
 	url := "http://proxylist.fatezero.org/proxy.list"
-	doc, err := pf.Get(url, false)
+	body, err := pf.GetBody(ctx, url, false)
 	if err != nil {
 		log.Printf("Failed to parse %s: %s", url, err)
 		return err
 	}
 
-	body := doc.Find("body").Text()
-	lines := strings.Split(body, "\n")
-	for _, line := range lines {
-		if len(line) == 0 {
-			continue
-		}
-
-		var jsonInfo map[string]interface{}
-		err := json.Unmarshal([]byte(line), &jsonInfo)
-		if err != nil {
-			return err
-		}
-
-		host := jsonInfo["host"].(string)
-		port := int(jsonInfo["port"].(float64))
-		proxy := fmt.Sprintf("%s:%d", host, port)
-		proxyChan <- proxy
-	}
-
-	return nil
+	// 每行一个 JSON 对象 {"host": "1.2.3.4", "port": 8080, "type": "http", ...}
+	cfg := SourceConfig{Name: "FreeProxy06", IP: "host", Port: "port", Protocol: "type"}
+	return parseJSONList(ctx, bytes.NewReader(body), cfg, proxyChan)
 }
 
-func (pf *ProxyFetcher) FreeProxy07(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy07(ctx context.Context, proxyChan chan<- Candidate) error {
 	urls := []string{"http://www.ip3366.net/free/?stype=1", "http://www.ip3366.net/free/?stype=2"}
+	proxyRegex := regexp.MustCompile(`<td>(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})</td>[\s\S]*?<td>(\d+)</td>`)
+	var errs []error
 	for _, url := range urls {
-		doc, err := pf.Get(url, false)
+		doc, err := pf.Get(ctx, url, false)
 		if err != nil {
 			fmt.Println("Error requesting URL:", err)
+			errs = append(errs, err)
 			continue
 		}
 
 		body, _ := doc.Html()
-		proxyRegex := regexp.MustCompile(`<td>(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})</td>[\s\S]*?<td>(\d+)</td>`)
-		matches := proxyRegex.FindAllStringSubmatch(body, -1)
-		for _, match := range matches {
-			ip := match[1]
-			port := match[2]
-			proxy := ip + ":" + port
-			proxyChan <- proxy
+		if err := sendMatches(ctx, proxyChan, "FreeProxy07", proxyRegex, body); err != nil {
+			return err
 		}
 	}
+	return errors.Join(errs...)
 }
 
-func (pf *ProxyFetcher) FreeProxy08(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy08(ctx context.Context, proxyChan chan<- Candidate) error {
 	urls := []string{"https://ip.ihuan.me/address/5Lit5Zu9.html"}
+	proxyRegex := regexp.MustCompile(`>\s*?(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\s*?</a></td><td>(\d+)</td>`)
+	var errs []error
 	for _, url := range urls {
-		doc, err := pf.Get(url, false)
+		doc, err := pf.Get(ctx, url, false)
 		if err != nil {
 			fmt.Println("Error requesting URL:", err)
+			errs = append(errs, err)
 			continue
 		}
 
 		html, err := doc.Html()
 		if err != nil {
 			fmt.Println("Error getting HTML content:", err)
+			errs = append(errs, err)
 			continue
 		}
 
-		proxyRegex := regexp.MustCompile(`>\s*?(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\s*?</a></td><td>(\d+)</td>`)
-		matches := proxyRegex.FindAllStringSubmatch(html, -1)
-		for _, match := range matches {
-			ip := match[1]
-			port := match[2]
-			proxy := ip + ":" + port
-			proxyChan <- proxy
+		if err := sendMatches(ctx, proxyChan, "FreeProxy08", proxyRegex, html); err != nil {
+			return err
 		}
 	}
+	return errors.Join(errs...)
 }
 
-func (pf *ProxyFetcher) FreeProxy09(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy09(ctx context.Context, proxyChan chan<- Candidate) error {
 	pageCount := 1
 	urlList := []string{}
 	for pageIndex := 1; pageIndex <= pageCount; pageIndex++ {
 		urlList = append(urlList, fmt.Sprintf("http://ip.jiangxianli.com/?country=中国&page=%d", pageIndex))
 	}
 
+	proxyRegex := regexp.MustCompile(`<td>(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})</td>[\s\S]*?<td>(\d+)</td>`)
+	var errs []error
 	for _, url := range urlList {
-		doc, err := pf.Get(url, false)
+		doc, err := pf.Get(ctx, url, false)
 		if err != nil {
 			fmt.Println("Error requesting URL:", err)
+			errs = append(errs, err)
 			continue
 		}
 
 		body, _ := doc.Html()
-		proxyRegex := regexp.MustCompile(`<td>(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})</td>[\s\S]*?<td>(\d+)</td>`)
-		matches := proxyRegex.FindAllStringSubmatch(body, -1)
-		for _, match := range matches {
-			ip := match[1]
-			port := match[2]
-			proxy := ip + ":" + port
-			proxyChan <- proxy
+		if err := sendMatches(ctx, proxyChan, "FreeProxy09", proxyRegex, body); err != nil {
+			return err
 		}
 	}
+	return errors.Join(errs...)
 }
 
-func (pf *ProxyFetcher) FreeProxy10(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy10(ctx context.Context, proxyChan chan<- Candidate) error {
 	pageCount := 100
 	var urls []string
 	for pageIndex := 1; pageIndex <= pageCount; pageIndex++ {
 		urls = append(urls, fmt.Sprintf("https://www.89ip.cn/index_%d.html", pageIndex))
 	}
+	proxyRegex := regexp.MustCompile(`<td.*?>[\s\S]*?(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})[\s\S]*?</td>[\s\S]*?<td.*?>[\s\S]*?(\d+)[\s\S]*?</td>`)
+	var errs []error
 	for _, url := range urls {
-		doc, err := pf.Get(url, false)
+		doc, err := pf.Get(ctx, url, false)
 		if err != nil {
 			fmt.Println("Error requesting URL:", err)
+			errs = append(errs, err)
 			continue
 		}
 
 		html, err := doc.Html()
 		if err != nil {
 			fmt.Println("Error getting HTML content:", err)
+			errs = append(errs, err)
 			continue
 		}
 
-		proxyRegex := regexp.MustCompile(`<td.*?>[\s\S]*?(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})[\s\S]*?</td>[\s\S]*?<td.*?>[\s\S]*?(\d+)[\s\S]*?</td>`)
-		matches := proxyRegex.FindAllStringSubmatch(html, -1)
-		for _, match := range matches {
-			ip := match[1]
-			port := match[2]
-			proxy := ip + ":" + port
-			proxyChan <- proxy
+		if err := sendMatches(ctx, proxyChan, "FreeProxy10", proxyRegex, html); err != nil {
+			return err
+		}
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return err
 		}
-		time.Sleep(5 * time.Second)
 	}
+	return errors.Join(errs...)
 }
 
-func (pf *ProxyFetcher) FreeProxy11(proxyChan chan<- string) {
+func (pf *ProxyFetcher) FreeProxy11(ctx context.Context, proxyChan chan<- Candidate) error {
 	pageCount := 10
 	var urlList []string
 	for pageIndex := 1; pageIndex <= pageCount; pageIndex++ {
 		urlList = append(urlList, fmt.Sprintf("https://list.proxylistplus.com/Fresh-HTTP-Proxy-List-%d", pageIndex))
 	}
 
+	proxyRegex := regexp.MustCompile(`<td>(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})</td>[\s\S]*?<td>(\d+)</td>`)
+	var errs []error
 	for _, url := range urlList {
-		doc, err := pf.Get(url, false)
+		doc, err := pf.Get(ctx, url, false)
 		if err != nil {
 			fmt.Println("Error requesting URL:", err)
+			errs = append(errs, err)
 			continue
 		}
 
 		body, _ := doc.Html()
-		proxyRegex := regexp.MustCompile(`<td>(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})</td>[\s\S]*?<td>(\d+)</td>`)
-		matches := proxyRegex.FindAllStringSubmatch(body, -1)
-		for _, match := range matches {
-			ip := match[1]
-			port := match[2]
-			proxy := ip + ":" + port
-			proxyChan <- proxy
+		if err := sendMatches(ctx, proxyChan, "FreeProxy11", proxyRegex, body); err != nil {
+			return err
 		}
 
-		time.Sleep(5 * time.Second)
+		if err := sleepContext(ctx, 5*time.Second); err != nil {
+			return err
+		}
 	}
+	return errors.Join(errs...)
 }
 
-func (pf *ProxyFetcher) run(fetchers []string, output chan string) {
-	wg := sync.WaitGroup{}
-	for _, fetcherName := range fetchers {
-		// 检查ProxyFetcher结构体是否存在与fetcherName相同的方法
-		methodValue := reflect.ValueOf(pf).MethodByName(fetcherName)
-		if methodValue.IsValid() {
-			wg.Add(1)
-			// 调用存在的方法
-			go func() {
-				//methodValue.Call(nil)
-				methodValue.Call([]reflect.Value{reflect.ValueOf(output)})
-				wg.Done()
-			}()
+// eachRow 遍历选中的元素, fn 返回错误时停止遍历并返回该错误
+func eachRow(sel *goquery.Selection, fn func(i int, s *goquery.Selection) error) error {
+	var err error
+	sel.EachWithBreak(func(i int, s *goquery.Selection) bool {
+		err = fn(i, s)
+		return err == nil
+	})
+	return err
+}
+
+// sendMatches 将正则匹配到的 ip(分组1) 和 port(分组2) 写入 out
+func sendMatches(ctx context.Context, out chan<- Candidate, source string, re *regexp.Regexp, body string) error {
+	for _, match := range re.FindAllStringSubmatch(body, -1) {
+		ip := match[1]
+		port := match[2]
+		if err := sendCandidate(ctx, out, Candidate{Proxy: ip + ":" + port, Source: source}); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// sleepContext 休眠 d, ctx 取消时提前返回错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	// 启动一个协程等待所有协程完成
-	go func() {
-		wg.Wait()
-		close(output) // 所有协程完成后关闭输出管道
-		log.Printf("All fetchers completed")
-	}()
+// run 并发执行采集源, 全部完成后关闭 output, 返回各采集源的错误
+func (pf *ProxyFetcher) run(ctx context.Context, srcs []ProxySource, output chan<- Candidate) error {
+	wg := sync.WaitGroup{}
+	errs := make([]error, len(srcs))
+	for i, src := range srcs {
+		wg.Add(1)
+		go func(i int, src ProxySource) {
+			defer wg.Done()
+			if err := src.Fetch(ctx, output); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", src.Name(), err)
+			}
+		}(i, src)
+	}
+
+	wg.Wait()
+	close(output) // 所有协程完成后关闭输出管道
+	log.Printf("All fetchers completed")
+	return errors.Join(errs...)
 }
 
 func testProxyFetcher() {
-	fetchers := []string{"FreeProxy10"} //"FreeProxy01","FreeProxy02",
-	proxyQueue := make(chan string)
+	srcs, err := LookupSources([]string{"FreeProxy10"}) //"FreeProxy01","FreeProxy02",
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxyQueue := make(chan Candidate)
 	pf := &ProxyFetcher{}
-	pf.run(fetchers, proxyQueue)
+	go func() {
+		if err := pf.run(context.Background(), srcs, proxyQueue); err != nil {
+			log.Printf("testProxyFetcher: %s", err)
+		}
+	}()
 
 	for proxy := range proxyQueue {
-		fmt.Println(proxy)
+		fmt.Println(proxy.Proxy)
 	}
 	log.Printf("testProxyFetcher completed")
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Candidate 采集源产出的待验证代理
+type Candidate struct {
+	Proxy    string
+	Source   string
+	Protocol string // 采集源标注的协议, 仅供参考, 以验证结果为准
+}
+
+// ProxySource 代理采集源接口
+type ProxySource interface {
+	// Name 返回采集源名称, 与 config.toml 中 ProxyFetcher 的取值对应
+	Name() string
+	// Fetch 采集代理并写入 out, ctx 取消时应尽快返回
+	Fetch(ctx context.Context, out chan<- Candidate) error
+}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = make(map[string]ProxySource)
+)
+
+// RegisterSource 注册采集源, 名称为空或重复时 panic
+func RegisterSource(src ProxySource) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	if src == nil {
+		panic("RegisterSource: source is nil")
+	}
+	name := src.Name()
+	if name == "" {
+		panic("RegisterSource: source name is empty")
+	}
+	if _, dup := sources[name]; dup {
+		panic("RegisterSource: called twice for source " + name)
+	}
+	sources[name] = src
+}
+
+// Sources 返回已注册的采集源名称, 按名称排序
+func Sources() []string {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	return namesLocked()
+}
+
+// LookupSources 按名称查找采集源, 存在未注册的名称时返回错误
+func LookupSources(names []string) ([]ProxySource, error) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	var result []ProxySource
+	var unknown []string
+	for _, name := range names {
+		src, ok := sources[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		result = append(result, src)
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown proxy source %s, registered: %s", strings.Join(unknown, ", "), strings.Join(namesLocked(), ", "))
+	}
+	return result, nil
+}
+
+func namesLocked() []string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SourceFunc 将普通函数包装为 ProxySource
+type SourceFunc struct {
+	name  string
+	fetch func(ctx context.Context, out chan<- Candidate) error
+}
+
+// NewSourceFunc 返回 SourceFunc 实例
+func NewSourceFunc(name string, fetch func(ctx context.Context, out chan<- Candidate) error) *SourceFunc {
+	return &SourceFunc{name: name, fetch: fetch}
+}
+
+func (s *SourceFunc) Name() string {
+	return s.name
+}
+
+func (s *SourceFunc) Fetch(ctx context.Context, out chan<- Candidate) error {
+	return s.fetch(ctx, out)
+}
+
+// sendCandidate 写入候选代理, ctx 取消时返回错误
+func sendCandidate(ctx context.Context, out chan<- Candidate, c Candidate) error {
+	select {
+	case out <- c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SourceFactory 根据配置创建采集源
+type SourceFactory func(pf *ProxyFetcher, cfg SourceConfig) (ProxySource, error)
+
+var sourceTypes = make(map[string]SourceFactory)
+
+// RegisterSourceType 注册声明式采集源类型, 类型重复时 panic
+func RegisterSourceType(typ string, factory SourceFactory) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	if _, dup := sourceTypes[typ]; dup {
+		panic("RegisterSourceType: called twice for type " + typ)
+	}
+	sourceTypes[typ] = factory
+}
+
+// RegisterConfigSources 根据 config.toml 中的 [[Sources]] 创建并注册采集源
+func RegisterConfigSources(pf *ProxyFetcher, cfgs []SourceConfig) error {
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return fmt.Errorf("source name is empty")
+		}
+		if cfg.Type == "" {
+			cfg.Type = "html"
+		}
+		sourcesMu.RLock()
+		factory, ok := sourceTypes[cfg.Type]
+		_, dup := sources[cfg.Name]
+		sourcesMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("source %s: unknown type %s", cfg.Name, cfg.Type)
+		}
+		if dup {
+			return fmt.Errorf("source %s: name already registered", cfg.Name)
+		}
+		src, err := factory(pf, cfg)
+		if err != nil {
+			return fmt.Errorf("source %s: %w", cfg.Name, err)
+		}
+		RegisterSource(src)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func init() {
+	RegisterSourceType("html", NewHTMLSource)
+}
+
+// HTMLSource 按 CSS 选择器或正则解析网页的声明式采集源
+type HTMLSource struct {
+	pf    *ProxyFetcher
+	cfg   SourceConfig
+	regex *regexp.Regexp
+}
+
+// NewHTMLSource 返回 HTMLSource 实例
+func NewHTMLSource(pf *ProxyFetcher, cfg SourceConfig) (ProxySource, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("URLs is empty")
+	}
+	s := &HTMLSource{pf: pf, cfg: cfg}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, err
+		}
+		if re.NumSubexp() < 1 {
+			return nil, errors.New("Regex has no capture group")
+		}
+		s.regex = re
+	} else if cfg.Row == "" || cfg.IP == "" {
+		return nil, errors.New("Row and IP selector are required when Regex is empty")
+	}
+	return s, nil
+}
+
+func (s *HTMLSource) Name() string {
+	return s.cfg.Name
+}
+
+func (s *HTMLSource) Fetch(ctx context.Context, out chan<- Candidate) error {
+	var errs []error
+	for i, url := range pageURLs(s.cfg) {
+		if i > 0 && s.cfg.Delay > 0 {
+			if err := sleepContext(ctx, time.Duration(s.cfg.Delay)*time.Second); err != nil {
+				return err
+			}
+		}
+		doc, err := s.pf.Get(ctx, url, s.cfg.Verify)
+		if err != nil {
+			log.Printf("%s failed to parse %s: %s", s.cfg.Name, url, err)
+			errs = append(errs, err)
+			continue
+		}
+		if s.regex != nil {
+			err = s.parseRegex(ctx, doc, out)
+		} else {
+			err = s.parseSelector(ctx, doc, out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *HTMLSource) parseSelector(ctx context.Context, doc *goquery.Document, out chan<- Candidate) error {
+	return eachRow(doc.Find(s.cfg.Row), func(i int, row *goquery.Selection) error {
+		if i < s.cfg.SkipRows {
+			return nil
+		}
+		ip := strings.TrimSpace(row.Find(s.cfg.IP).First().Text())
+		port := ""
+		if s.cfg.Port != "" {
+			port = strings.TrimSpace(row.Find(s.cfg.Port).First().Text())
+		}
+		protocol := ""
+		if s.cfg.Protocol != "" {
+			protocol = strings.TrimSpace(row.Find(s.cfg.Protocol).First().Text())
+		}
+		return s.send(ctx, out, ip, port, protocol)
+	})
+}
+
+func (s *HTMLSource) parseRegex(ctx context.Context, doc *goquery.Document, out chan<- Candidate) error {
+	html, err := doc.Html()
+	if err != nil {
+		return err
+	}
+	ipIndex, portIndex, protocolIndex := s.regex.SubexpIndex("ip"), s.regex.SubexpIndex("port"), s.regex.SubexpIndex("protocol")
+	if ipIndex < 0 {
+		ipIndex = 1
+	}
+	if portIndex < 0 && s.regex.NumSubexp() >= 2 {
+		portIndex = 2
+	}
+	for _, match := range s.regex.FindAllStringSubmatch(html, -1) {
+		port, protocol := "", ""
+		if portIndex > 0 {
+			port = match[portIndex]
+		}
+		if protocolIndex > 0 {
+			protocol = match[protocolIndex]
+		}
+		if err := s.send(ctx, out, match[ipIndex], port, protocol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *HTMLSource) send(ctx context.Context, out chan<- Candidate, ip, port, protocol string) error {
+	return sendProxy(ctx, out, s.cfg.Name, ip, port, protocol)
+}
+
+// sendProxy 拼接 ip 和 port 后写入 out, port 为空时 ip 视为 ip:port
+func sendProxy(ctx context.Context, out chan<- Candidate, source, ip, port, protocol string) error {
+	ip, port = strings.TrimSpace(ip), strings.TrimSpace(port)
+	proxy := ip
+	if port != "" {
+		proxy = net.JoinHostPort(strings.Trim(ip, "[]"), port)
+	}
+	if proxy == "" {
+		return nil
+	}
+	return sendCandidate(ctx, out, Candidate{Proxy: proxy, Source: source, Protocol: strings.ToLower(strings.TrimSpace(protocol))})
+}
+
+// pageURLs 展开 URL 模板中的 {page}
+func pageURLs(cfg SourceConfig) []string {
+	start := cfg.PageStart
+	if start <= 0 {
+		start = 1
+	}
+	end := cfg.PageEnd
+	if end < start {
+		end = start
+	}
+	var urls []string
+	for _, tmpl := range cfg.URLs {
+		if !strings.Contains(tmpl, "{page}") {
+			urls = append(urls, tmpl)
+			continue
+		}
+		for page := start; page <= end; page++ {
+			urls = append(urls, strings.ReplaceAll(tmpl, "{page}", strconv.Itoa(page)))
+		}
+	}
+	return urls
+}
+
+func testHTMLSource() {
+	src, err := NewHTMLSource(&ProxyFetcher{}, SourceConfig{
+		Name:    "ip3366",
+		URLs:    []string{"http://www.ip3366.net/free/?stype=1&page={page}"},
+		PageEnd: 2,
+		Row:     "table tr",
+		IP:      "td:nth-child(1)",
+		Port:    "td:nth-child(2)",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	out := make(chan Candidate)
+	go func() {
+		if err := src.Fetch(context.Background(), out); err != nil {
+			fmt.Println(err)
+		}
+		close(out)
+	}()
+	for c := range out {
+		fmt.Println(c.Proxy)
+	}
+}
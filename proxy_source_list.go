@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func init() {
+	RegisterSourceType("text", NewListSource)
+	RegisterSourceType("csv", NewListSource)
+	RegisterSourceType("json", NewListSource)
+	RegisterSourceType("jsonl", NewListSource)
+}
+
+type listParser func(ctx context.Context, r io.Reader, cfg SourceConfig, out chan<- Candidate) error
+
+// ListSource 读取文本、CSV、JSON/JSONL 代理列表的声明式采集源, 支持 http(s) URL 和本地文件
+type ListSource struct {
+	pf    *ProxyFetcher
+	cfg   SourceConfig
+	parse listParser
+}
+
+// NewListSource 返回 ListSource 实例
+func NewListSource(pf *ProxyFetcher, cfg SourceConfig) (ProxySource, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("URLs is empty")
+	}
+	s := &ListSource{pf: pf, cfg: cfg}
+	switch cfg.Type {
+	case "text":
+		s.parse = parseTextList
+	case "csv":
+		if cfg.IP == "" {
+			return nil, errors.New("IP column is required")
+		}
+		if utf8.RuneCountInString(cfg.Delimiter) > 1 {
+			return nil, errors.New("Delimiter must be a single character")
+		}
+		s.parse = parseCSVList
+	case "json", "jsonl":
+		if cfg.IP == "" {
+			return nil, errors.New("IP field is required")
+		}
+		s.parse = parseJSONList
+	default:
+		return nil, fmt.Errorf("unsupported list type %s", cfg.Type)
+	}
+	return s, nil
+}
+
+func (s *ListSource) Name() string {
+	return s.cfg.Name
+}
+
+func (s *ListSource) Fetch(ctx context.Context, out chan<- Candidate) error {
+	var errs []error
+	requested := false
+	for _, location := range pageURLs(s.cfg) {
+		if !isRemoteURL(location) {
+			if err := s.fetchFiles(ctx, location, out); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if requested && s.cfg.Delay > 0 {
+			if err := sleepContext(ctx, time.Duration(s.cfg.Delay)*time.Second); err != nil {
+				return err
+			}
+		}
+		requested = true
+		body, err := s.pf.GetBody(ctx, location, s.cfg.Verify)
+		if err != nil {
+			log.Printf("%s failed to get %s: %s", s.cfg.Name, location, err)
+			errs = append(errs, err)
+			continue
+		}
+		if err := s.parse(ctx, bytes.NewReader(body), s.cfg, out); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", location, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fetchFiles 读取匹配 pattern 的本地文件
+func (s *ListSource) fetchFiles(ctx context.Context, pattern string, out chan<- Candidate) error {
+	pattern = strings.TrimPrefix(pattern, "file://")
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no file matches %s", pattern)
+	}
+	var errs []error
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = s.parse(ctx, file, s.cfg, out)
+		file.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isRemoteURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// parseTextList 解析每行一个代理的文本, 支持 "ip:port" 和 "socks5://ip:port", # 开头为注释
+func parseTextList(ctx context.Context, r io.Reader, cfg SourceConfig, out chan<- Candidate) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line <= cfg.SkipRows {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		proxy, protocol := fields[0], ""
+		if i := strings.Index(proxy, "://"); i >= 0 {
+			protocol, proxy = proxy[:i], proxy[i+3:]
+		}
+		if err := sendProxy(ctx, out, cfg.Name, proxy, "", protocol); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseCSVList 解析 CSV, 列可以是列序号或表头中的列名
+func parseCSVList(ctx context.Context, r io.Reader, cfg SourceConfig, out chan<- Candidate) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if cfg.Delimiter != "" {
+		reader.Comma, _ = utf8.DecodeRuneInString(cfg.Delimiter)
+	}
+
+	for i := 0; i < cfg.SkipRows; i++ {
+		if _, err := reader.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	columns := []string{cfg.IP, cfg.Port, cfg.Protocol}
+	index := []int{-1, -1, -1}
+	byName := false
+	for i, column := range columns {
+		if column == "" {
+			continue
+		}
+		n, err := strconv.Atoi(column)
+		if err != nil {
+			byName = true
+			continue
+		}
+		index[i] = n
+	}
+	if byName {
+		header, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		for i, column := range columns {
+			if column == "" || index[i] >= 0 {
+				continue
+			}
+			for j, name := range header {
+				if strings.EqualFold(strings.TrimSpace(name), column) {
+					index[i] = j
+					break
+				}
+			}
+			if index[i] < 0 {
+				return fmt.Errorf("column %s not found in header", column)
+			}
+		}
+	}
+
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sendProxy(ctx, out, cfg.Name, field(record, index[0]), field(record, index[1]), field(record, index[2])); err != nil {
+			return err
+		}
+	}
+}
+
+// parseJSONList 解析 JSON 或 JSON lines, 字段路径以 . 分隔, 数组下标用数字
+func parseJSONList(ctx context.Context, r io.Reader, cfg SourceConfig, out chan<- Candidate) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for {
+		var value interface{}
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		items, ok := jsonField(value, cfg.Root).([]interface{})
+		if !ok {
+			items = []interface{}{jsonField(value, cfg.Root)}
+		}
+		for _, item := range items {
+			ip := jsonString(jsonField(item, cfg.IP))
+			port := jsonString(jsonField(item, cfg.Port))
+			protocol := jsonString(jsonField(item, cfg.Protocol))
+			if err := sendProxy(ctx, out, cfg.Name, ip, port, protocol); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// jsonField 按路径取值, 路径为空时返回 value 本身
+func jsonField(value interface{}, path string) interface{} {
+	if path == "" {
+		return value
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case map[string]interface{}, []interface{}:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// collectList 用 parse 解析 input, 返回采集到的代理
+func collectList(t *testing.T, parse listParser, cfg SourceConfig, input string) ([]Candidate, error) {
+	t.Helper()
+	out := make(chan Candidate, 100)
+	err := parse(context.Background(), strings.NewReader(input), cfg, out)
+	close(out)
+	var got []Candidate
+	for c := range out {
+		got = append(got, c)
+	}
+	return got, err
+}
+
+func TestParseTextList(t *testing.T) {
+	input := "# comment\n1.2.3.4:80\n\n  socks5://5.6.7.8:1080  extra\nSOCKS4://[2001:db8::1]:1080\n"
+	tests := []struct {
+		name string
+		cfg  SourceConfig
+		want []Candidate
+	}{
+		{"all", SourceConfig{Name: "list"}, []Candidate{
+			{Proxy: "1.2.3.4:80", Source: "list"},
+			{Proxy: "5.6.7.8:1080", Source: "list", Protocol: "socks5"},
+			{Proxy: "[2001:db8::1]:1080", Source: "list", Protocol: "socks4"},
+		}},
+		{"skip rows", SourceConfig{Name: "list", SkipRows: 3}, []Candidate{
+			{Proxy: "5.6.7.8:1080", Source: "list", Protocol: "socks5"},
+			{Proxy: "[2001:db8::1]:1080", Source: "list", Protocol: "socks4"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := collectList(t, parseTextList, tt.cfg, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCSVList(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SourceConfig
+		input   string
+		want    []Candidate
+		wantErr bool
+	}{
+		{
+			name:  "column index",
+			cfg:   SourceConfig{Name: "csv", IP: "0", Port: "1"},
+			input: "1.2.3.4,80\n5.6.7.8, 8080\n",
+			want:  []Candidate{{Proxy: "1.2.3.4:80", Source: "csv"}, {Proxy: "5.6.7.8:8080", Source: "csv"}},
+		},
+		{
+			name:  "header names",
+			cfg:   SourceConfig{Name: "csv", IP: "IP", Port: "port", Protocol: "type"},
+			input: "type,ip,port\nHTTPS,1.2.3.4,443\nsocks5,2001:db8::1,1080\n",
+			want: []Candidate{
+				{Proxy: "1.2.3.4:443", Source: "csv", Protocol: "https"},
+				{Proxy: "[2001:db8::1]:1080", Source: "csv", Protocol: "socks5"},
+			},
+		},
+		{
+			name:  "ip:port column with delimiter and skip rows",
+			cfg:   SourceConfig{Name: "csv", IP: "1", Delimiter: ";", SkipRows: 1},
+			input: "generated today\nus;1.2.3.4:80\njp;5.6.7.8:3128\n",
+			want:  []Candidate{{Proxy: "1.2.3.4:80", Source: "csv"}, {Proxy: "5.6.7.8:3128", Source: "csv"}},
+		},
+		{
+			name:  "short rows are skipped",
+			cfg:   SourceConfig{Name: "csv", IP: "0", Port: "1"},
+			input: "1.2.3.4,80\n\n,\n",
+			want:  []Candidate{{Proxy: "1.2.3.4:80", Source: "csv"}},
+		},
+		{
+			name:  "empty input",
+			cfg:   SourceConfig{Name: "csv", IP: "ip"},
+			input: "",
+		},
+		{
+			name:    "missing column",
+			cfg:     SourceConfig{Name: "csv", IP: "ip", Port: "port"},
+			input:   "ip,host\n1.2.3.4,80\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed quote",
+			cfg:     SourceConfig{Name: "csv", IP: "0"},
+			input:   "\"1.2.3.4:80\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := collectList(t, parseCSVList, tt.cfg, tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONList(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SourceConfig
+		input   string
+		want    []Candidate
+		wantErr bool
+	}{
+		{
+			name:  "array with numeric port",
+			cfg:   SourceConfig{Name: "json", IP: "ip", Port: "port", Protocol: "protocol"},
+			input: `[{"ip":"1.2.3.4","port":80,"protocol":"HTTP"},{"ip":"5.6.7.8","port":"1080"}]`,
+			want: []Candidate{
+				{Proxy: "1.2.3.4:80", Source: "json", Protocol: "http"},
+				{Proxy: "5.6.7.8:1080", Source: "json"},
+			},
+		},
+		{
+			name:  "nested root and field paths",
+			cfg:   SourceConfig{Name: "json", Root: "data.list", IP: "addr.host", Port: "addr.ports.0"},
+			input: `{"data":{"list":[{"addr":{"host":"1.2.3.4","ports":[8080,80]}}]}}`,
+			want:  []Candidate{{Proxy: "1.2.3.4:8080", Source: "json"}},
+		},
+		{
+			name:  "json lines",
+			cfg:   SourceConfig{Name: "jsonl", IP: "proxy"},
+			input: "{\"proxy\":\"1.2.3.4:80\"}\n{\"proxy\":\"[2001:db8::1]:8080\"}\n",
+			want: []Candidate{
+				{Proxy: "1.2.3.4:80", Source: "jsonl"},
+				{Proxy: "[2001:db8::1]:8080", Source: "jsonl"},
+			},
+		},
+		{
+			name:  "missing fields are skipped",
+			cfg:   SourceConfig{Name: "json", IP: "ip", Port: "port"},
+			input: `[{"host":"1.2.3.4"},{"ip":{"v":1}},{"ip":"1.2.3.4","port":80}]`,
+			want:  []Candidate{{Proxy: "1.2.3.4:80", Source: "json"}},
+		},
+		{
+			name:    "malformed json",
+			cfg:     SourceConfig{Name: "json", IP: "ip"},
+			input:   `[{"ip":"1.2.3.4"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := collectList(t, parseJSONList, tt.cfg, tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,34 +1,93 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
-	"net/url"
+	"net/http/httptrace"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	// IP_REGEX 用于匹配代理格式
-	IP_REGEX = regexp.MustCompile(`(.*:.*@)?\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}:\d{1,5}`)
+	// hostnameRegex 用于匹配代理的域名
+	hostnameRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
 )
 
+// 代理类型掩码, 对应 ProxyItem.Type
+const (
+	ProxyTypeHTTP    = 0x1
+	ProxyTypeHTTPS   = 0x10
+	ProxyTypeSocks5  = 0x100
+	ProxyTypeSocks4  = 0x10000
+	ProxyTypeSocks4a = 0x100000
+)
+
+// protocolChecks 各协议的验证顺序及对应的类型掩码, 每个协议单独验证
+var protocolChecks = []struct {
+	protocol  string
+	proxyType int
+}{
+	{"http", ProxyTypeHTTP},
+	{"https", ProxyTypeHTTPS},
+	{Socks5, ProxyTypeSocks5},
+	{Socks4, ProxyTypeSocks4},
+	{Socks4a, ProxyTypeSocks4a},
+}
+
+// VerifyResult 代理验证结果
+type VerifyResult struct {
+	Type       int                // 代理类型掩码, 0 表示不可用
+	Anonymity  Anonymity          // 匿名级别
+	Latencies  map[string]Latency // 各协议的耗时
+	Throughput float64            // 下载速度(KB/s), 未测速时为 0
+	Checks     []CheckRecord      // 各协议的验证记录
+	Profiles   []ProfileResult    // 各 Profile 的验证结果, 基本验证失败时为空
+	MITM       bool               // https 隧道可用但证书未通过校验
+	ExitIP     string             // judge 接口看到的来源 IP, 未检测时为空
+}
+
+// Latency 单次请求各阶段的耗时, 单位毫秒
+type Latency struct {
+	Connect int64 `json:"connect"` // 与代理建立连接, 包括代理握手和 TLS 握手
+	TTFB    int64 `json:"ttfb"`    // 收到响应首字节
+	Total   int64 `json:"total"`   // 读取完整响应
+}
+
+// maxCheckBody 验证时最多读取的响应内容长度
+const maxCheckBody = 2 << 20
+
 // ProxyValidator 类用于验证代理
 type ProxyValidator struct {
 	httpUrl       string
 	httpsUrl      string
+	judgeUrl      string
+	speedTestUrl  string
 	verifyTimeout int
+	verifyTLS     bool
+	rootCAs       *x509.CertPool
+	certPin       string
+	httpCheck     *ContentCheck
+	httpsCheck    *ContentCheck
+	realIP        realIPCache
+	geo           GeoResolver
+	profiles      []*Profile
 }
 
-// NewProxyValidator 返回 ProxyValidator 实例
-func NewProxyValidator(httpURL, httpsURL string, timeout int) *ProxyValidator {
+// NewProxyValidator 返回 ProxyValidator 实例, judgeURL 为空时不检测匿名级别
+func NewProxyValidator(httpURL, httpsURL, judgeURL string, timeout int) *ProxyValidator {
 	return &ProxyValidator{
 		httpUrl:       httpURL,
 		httpsUrl:      httpsURL,
+		judgeUrl:      judgeURL,
 		verifyTimeout: timeout,
 	}
 }
@@ -39,153 +98,385 @@ func (pv *ProxyValidator) Initialize(httpURL, httpsURL string) {
 	pv.httpsUrl = httpsURL
 }
 
+// SetSpeedTestURL 设置测速文件地址, 为空时不测速
+func (pv *ProxyValidator) SetSpeedTestURL(speedTestURL string) {
+	pv.speedTestUrl = speedTestURL
+}
+
+// SetVerifyTLS 设置是否校验证书, 校验时证书无效的 https 验证视为失败
+func (pv *ProxyValidator) SetVerifyTLS(verify bool) {
+	pv.verifyTLS = verify
+}
+
+// SetCertPool 设置校验证书使用的 CA, 为 nil 时使用系统证书; pin 为 HttpsURL 证书的 SHA256 指纹, 为空时不固定
+func (pv *ProxyValidator) SetCertPool(rootCAs *x509.CertPool, pin string) {
+	pv.rootCAs = rootCAs
+	pv.certPin = pin
+}
+
+// SetContentChecks 设置 HttpURL 和 HttpsURL 响应内容的断言, 为 nil 时不检查
+func (pv *ProxyValidator) SetContentChecks(httpCheck, httpsCheck *ContentCheck) {
+	pv.httpCheck = httpCheck
+	pv.httpsCheck = httpsCheck
+}
+
+// SetProfiles 设置在 http/https 验证通过后额外执行的 Profile
+func (pv *ProxyValidator) SetProfiles(profiles []*Profile) {
+	pv.profiles = profiles
+}
+
+// SetGeoResolver 设置查询地理位置的 GeoResolver
+func (pv *ProxyValidator) SetGeoResolver(geo GeoResolver) {
+	pv.geo = geo
+}
+
 // FormatValidator 检查代理格式是否合法
 func (pv *ProxyValidator) FormatValidator(proxy string) bool {
-	return IP_REGEX.MatchString(proxy)
+	_, err := NormalizeProxy(proxy)
+	return err == nil
 }
 
-// TimeoutValidator 检测代理超时
-func (pv *ProxyValidator) TimeoutValidator(proxy, protocol string) bool {
-	proxies := map[string]string{
-		"http":   fmt.Sprintf("http://%s", proxy),
-		"https":  fmt.Sprintf("https://%s", proxy),
-		"socks5": fmt.Sprintf("socks5://%s", proxy),
+// NormalizeProxy 检查并规范化代理地址, 支持 ip:port、[ipv6]:port、host:port 以及 user:pass@ 前缀,
+// IPv6 转换为压缩格式, 域名转换为小写, 保证同一个代理在数据库中只有一种写法
+func NormalizeProxy(proxy string) (string, error) {
+	username, password, addr := splitProxyAuth(strings.TrimSpace(proxy))
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
 	}
-
-	proxys := proxies[protocol]
-	if protocol == "https" {
-		proxys = proxies["http"]
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %s", port)
 	}
-	// 创建代理 URL
-	proxyURL, err := url.Parse(proxys)
-	if err != nil {
-		fmt.Println("无法解析代理 URL:", err)
-		return false
+	// 去掉前导零和正号, 避免同一个代理因 :080 和 :80 保存两次
+	port = strconv.Itoa(n)
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(host)
+		// 顶级域名不能是纯数字, 避免把 1.2.3.256 这类错误的 IP 当作域名
+		tld := host[strings.LastIndex(host, ".")+1:]
+		if len(host) > 253 || !hostnameRegex.MatchString(host) || strings.Trim(tld, "0123456789") == "" {
+			return "", fmt.Errorf("invalid host %s", host)
+		}
 	}
-
-	// 创建自定义的 Transport，并设置代理
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		Proxy:           http.ProxyURL(proxyURL),
+	addr = net.JoinHostPort(host, port)
+	if strings.Contains(proxy, "@") {
+		return username + ":" + password + "@" + addr, nil
 	}
+	return addr, nil
+}
 
-	// 创建自定义的 Client
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   time.Duration(pv.verifyTimeout) * time.Second,
+// canonicalProxy 返回规范化的代理地址, 格式不合法时原样返回
+func canonicalProxy(proxy string) string {
+	if normalized, err := NormalizeProxy(proxy); err == nil {
+		return normalized
 	}
+	return proxy
+}
 
-	httpsUrl := pv.httpsUrl
-	if protocol == "http" {
-		httpsUrl = pv.httpUrl
+// TimeoutValidator 检测代理超时并检查响应内容, protocol 为 http、https、socks5、socks4 或 socks4a, 返回各阶段耗时
+func (pv *ProxyValidator) TimeoutValidator(proxy, protocol string) (Latency, error) {
+	client, err := pv.newClient(proxy, protocol)
+	if err != nil {
+		return Latency{}, err
 	}
 
-	req, err := http.NewRequest("GET", httpsUrl, nil)
+	req, err := http.NewRequest("GET", pv.checkTarget(protocol), nil)
 	if err != nil {
-		return false
+		return Latency{}, err
 	}
 
 	// 设置请求头
 	pv.setRequestHeaders(req)
 
-	// 设置代理
-	//req.Header.Set("ProxyItem", proxies[protocol])
+	var latency Latency
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			latency.Connect = sinceMillis(start)
+		},
+		GotFirstResponseByte: func() {
+			latency.TTFB = sinceMillis(start)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Failed to get url:", err)
-		return false
+		return latency, certError(err)
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode == http.StatusOK
+	if protocol == "https" && pv.verifyTLS {
+		if err := checkPin(resp.TLS, pv.certPin); err != nil {
+			return latency, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return latency, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return latency, err
+	}
+	latency.Total = sinceMillis(start)
+
+	return latency, pv.contentCheck(protocol).Check(body)
 }
 
-// CustomValidatorExample 自定义验证函数示例
-func (pv *ProxyValidator) CustomValidatorExample(proxy string) bool {
-	// 自定义验证逻辑
-	return false
+// contentCheck 返回验证 protocol 时对响应内容的断言
+func (pv *ProxyValidator) contentCheck(protocol string) *ContentCheck {
+	if protocol == "https" {
+		return pv.httpsCheck
+	}
+	return pv.httpCheck
 }
 
-type IPData struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data Data   `json:"data"`
+// checkTarget 返回验证 protocol 时访问的地址
+func (pv *ProxyValidator) checkTarget(protocol string) string {
+	if protocol == "https" {
+		return pv.httpsUrl
+	}
+	return pv.httpUrl
 }
 
-type Data struct {
-	Address string `json:"address"`
-	IP      string `json:"ip"`
+// sinceMillis 返回距 start 的毫秒数, 不足 1 毫秒按 1 毫秒计, 0 用于表示未测量
+func sinceMillis(start time.Time) int64 {
+	if ms := time.Since(start).Milliseconds(); ms > 0 {
+		return ms
+	}
+	return 1
 }
 
-// 返回的JSON结构 {"code":200,"msg":"success","data":{"address":"中国 上海 上海 电信","ip":"101.230.187.69"}}
-func (pv *ProxyValidator) regionGetter(proxy string) (string, error) {
-	// 带有用户名密码的格式
-	parts := strings.Split(proxy, "@")
-	if len(parts) == 2 {
-		proxy = parts[1]
+// SpeedValidator 通过代理下载测速文件, 返回下载速度(KB/s)
+func (pv *ProxyValidator) SpeedValidator(proxy, protocol string) (float64, error) {
+	client, err := pv.newClient(proxy, protocol)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", pv.speedTestUrl, nil)
+	if err != nil {
+		return 0, err
 	}
-	ip := strings.Split(proxy, ":")[0]
-	httpsUrl := fmt.Sprintf("https://searchplugin.csdn.net/api/v1/ip/get?ip=%s", ip)
+	pv.setRequestHeaders(req)
 
-	resp, err := http.Get(httpsUrl)
+	start := time.Now()
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return 0, nil
 	}
+	return float64(n) / 1024 / elapsed, nil
+}
 
-	var ipData IPData
-	err = json.Unmarshal(body, &ipData)
-	if err != nil {
-		return "", err
+// newClient 创建通过代理访问的 http.Client, proxy 为空时直连
+func (pv *ProxyValidator) newClient(proxy, protocol string) (*http.Client, error) {
+	// 创建自定义的 Transport
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: !pv.verifyTLS, RootCAs: pv.rootCAs},
 	}
 
-	if ipData.Code == 200 {
-		return ipData.Data.Address, nil
+	switch {
+	case proxy == "":
+	case protocol == "http" || protocol == "https":
+		// https 通过 HTTP 代理的 CONNECT 隧道访问
+		transport.Proxy = http.ProxyURL(httpProxyURL(proxy))
+	case protocol == Socks5 || protocol == Socks4 || protocol == Socks4a:
+		// SOCKS 代理完成握手后直接访问目标
+		transport.DialContext = NewSocksDialer(protocol, proxy).DialContext
+	default:
+		return nil, fmt.Errorf("unknown protocol %s", protocol)
 	}
 
-	return "", fmt.Errorf("API response code is not 200")
+	// 创建自定义的 Client
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(pv.verifyTimeout) * time.Second,
+	}, nil
 }
 
-// VerifyProxy 验证代理
-func (pv *ProxyValidator) VerifyProxy(proxy string) int {
-	isValid := pv.FormatValidator(proxy)
-	proxyType := 0
+// judge 通过代理访问 JudgeURL, proxy 为空时直连
+func (pv *ProxyValidator) judge(proxy, protocol string) (*JudgeResponse, error) {
+	client, err := pv.newClient(proxy, protocol)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", pv.judgeUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	pv.setRequestHeaders(req)
 
-	if isValid {
-		isValid = pv.TimeoutValidator(proxy, "http")
-		if isValid {
-			proxyType = 0x1
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return readJudgeResponse(resp)
+}
+
+// AnonymityValidator 通过 judge 接口检测代理的匿名级别和出口 IP
+func (pv *ProxyValidator) AnonymityValidator(proxy, protocol string) (Anonymity, string) {
+	if pv.judgeUrl == "" {
+		return AnonymityUnknown, ""
+	}
+	realIP := pv.realIP.get(func() (string, error) {
+		judge, err := pv.judge("", "")
+		if err != nil {
+			return "", err
 		}
+		// 直连时可能经过多层转发, 取第一个来源 IP
+		origin, _, _ := strings.Cut(judge.Origin, ",")
+		return strings.TrimSpace(origin), nil
+	})
+
+	judge, err := pv.judge(proxy, protocol)
+	if err != nil {
+		fmt.Println("Failed to get judge:", err)
+		return AnonymityUnknown, ""
+	}
+	return classifyAnonymity(judge, realIP), exitIP(judge)
+}
+
+// ConnectValidator 检测代理端口是否可以连接
+func (pv *ProxyValidator) ConnectValidator(proxy string) bool {
+	_, _, addr := splitProxyAuth(proxy)
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(pv.verifyTimeout)*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// regionGetter 查询代理 IP 的地理位置
+func (pv *ProxyValidator) regionGetter(proxy string) (*GeoInfo, error) {
+	if pv.geo == nil {
+		return nil, errors.New("geo resolver is not set")
+	}
+	// 带有用户名密码的格式
+	_, _, addr := splitProxyAuth(proxy)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
 	}
 
-	if isValid {
-		isValid = pv.TimeoutValidator(proxy, "https")
-		if isValid {
-			proxyType |= 0x10
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pv.verifyTimeout)*time.Second)
+	defer cancel()
+	if net.ParseIP(host) == nil {
+		// 域名代理按解析出的第一个地址查询
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
 		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no address for %s", host)
+		}
+		host = addrs[0].IP.String()
 	}
+	return pv.geo.Resolve(ctx, host)
+}
 
-	if isValid {
-		isValid = pv.TimeoutValidator(proxy, "socks5")
-		if isValid {
-			proxyType |= 0x100
+// VerifyProxy 验证代理, 返回的 Type 为 0 表示不可用
+func (pv *ProxyValidator) VerifyProxy(proxy string) *VerifyResult {
+	result := &VerifyResult{Latencies: make(map[string]Latency)}
+	_, _, addr := splitProxyAuth(proxy)
+	if !pv.FormatValidator(proxy) {
+		result.Checks = []CheckRecord{{Time: time.Now(), Protocol: "tcp", Error: "format", Target: addr}}
+		return result
+	}
+	if !pv.ConnectValidator(proxy) {
+		result.Checks = []CheckRecord{{Time: time.Now(), Protocol: "tcp", Error: "connect", Target: addr}}
+		return result
+	}
+
+	// 各协议并发验证, 总耗时取决于最慢的协议
+	latencies := make([]Latency, len(protocolChecks))
+	errs := make([]error, len(protocolChecks))
+	var wg sync.WaitGroup
+	for i, check := range protocolChecks {
+		wg.Add(1)
+		go func(i int, protocol string) {
+			defer wg.Done()
+			latencies[i], errs[i] = pv.TimeoutValidator(proxy, protocol)
+		}(i, check.protocol)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	firstProtocol := ""
+	for i, check := range protocolChecks {
+		result.Checks = append(result.Checks, CheckRecord{
+			Time:     now,
+			Protocol: check.protocol,
+			Success:  errs[i] == nil,
+			Latency:  latencies[i].Total,
+			Error:    classifyError(errs[i]),
+			Target:   pv.checkTarget(check.protocol),
+		})
+		if errs[i] != nil {
+			fmt.Printf("%s %s check fail: %s\n", redactProxy(proxy), check.protocol, errs[i])
+			if check.proxyType == ProxyTypeHTTPS && errors.Is(errs[i], errBadCert) {
+				// 隧道可用但证书被替换, 仍记为支持 https, 查询时默认排除
+				result.Type |= ProxyTypeHTTPS
+				result.MITM = true
+			}
+			continue
+		}
+		result.Type |= check.proxyType
+		result.Latencies[check.protocol] = latencies[i]
+		if firstProtocol == "" {
+			firstProtocol = check.protocol
 		}
 	}
 
-	if isValid {
-		isValid = pv.CustomValidatorExample(proxy)
-		if isValid {
-			proxyType |= 0x1000
+	if firstProtocol != "" {
+		result.Anonymity, result.ExitIP = pv.AnonymityValidator(proxy, firstProtocol)
+		if pv.speedTestUrl != "" {
+			throughput, err := pv.SpeedValidator(proxy, firstProtocol)
+			if err != nil {
+				fmt.Printf("%s speed test fail: %s\n", redactProxy(proxy), err)
+			}
+			result.Throughput = throughput
+		}
+		result.Profiles = pv.verifyProfiles(proxy, firstProtocol)
+		for i, profile := range result.Profiles {
+			result.Checks = append(result.Checks, CheckRecord{
+				Time:     now,
+				Protocol: "profile:" + profile.Name,
+				Success:  profile.Success,
+				Latency:  profile.Latency,
+				Error:    classifyError(profile.Error),
+				Target:   pv.profiles[i].URL,
+			})
 		}
 	}
 
-	return proxyType
+	return result
+}
+
+// splitProxyAuth 拆分 user:pass@host:port 格式的代理
+func splitProxyAuth(proxy string) (username, password, addr string) {
+	i := strings.LastIndex(proxy, "@")
+	if i < 0 {
+		return "", "", proxy
+	}
+	username, password, _ = strings.Cut(proxy[:i], ":")
+	return username, password, proxy[i+1:]
 }
 
 // setRequestHeaders 设置请求头
@@ -206,13 +497,18 @@ func testProxyValidator() {
 	HTTP_URL := "http://httpbin.org"
 	HTTPS_URL := "https://www.qq.com"
 
-	proxyValidator := NewProxyValidator(HTTP_URL, HTTPS_URL, 5)
+	proxyValidator := NewProxyValidator(HTTP_URL, HTTPS_URL, "http://httpbin.org/get", 5)
 	//proxyValidator.Initialize("http://example.com", "https://example.com")
 
 	//proxy := "192.168.92.152:1080"
 	proxy := "proxy:ztgame123456@211.159.201.232:18187"
-	isValid := proxyValidator.VerifyProxy(proxy)
-	fmt.Printf("代理验证结果:%0x\n", isValid)
-	region, _ := proxyValidator.regionGetter(proxy)
-	fmt.Println("代理%s的地址:", proxy, region)
+	result := proxyValidator.VerifyProxy(proxy)
+	fmt.Printf("代理验证结果:%0x %s\n", result.Type, result.Anonymity)
+	proxyValidator.SetGeoResolver(NewHTTPGeoResolver(5 * time.Second))
+	region, err := proxyValidator.regionGetter(proxy)
+	if err != nil {
+		fmt.Println("查询地址失败:", err)
+		return
+	}
+	fmt.Printf("代理%s的地址: %s\n", proxy, region)
 }
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestNormalizeProxy(t *testing.T) {
+	tests := []struct {
+		proxy   string
+		want    string
+		wantErr bool
+	}{
+		{"1.2.3.4:80", "1.2.3.4:80", false},
+		{" 1.2.3.4:8080 ", "1.2.3.4:8080", false},
+		{"1.2.3.4:080", "1.2.3.4:80", false},
+		{"1.2.3.4:+80", "1.2.3.4:80", false},
+		{"[2001:db8::1]:8080", "[2001:db8::1]:8080", false},
+		{"[2001:0DB8:0:0:0:0:0:1]:08080", "[2001:db8::1]:8080", false},
+		{"[::ffff:1.2.3.4]:80", "1.2.3.4:80", false},
+		{"Proxy.Example.COM:3128", "proxy.example.com:3128", false},
+		{"localhost:1080", "localhost:1080", false},
+		{"user:pass@1.2.3.4:0080", "user:pass@1.2.3.4:80", false},
+		{"user:p@ss@[2001:db8::1]:1080", "user:p@ss@[2001:db8::1]:1080", false},
+		{"1.2.3.4", "", true},
+		{"1.2.3.4:", "", true},
+		{"1.2.3.4:0", "", true},
+		{"1.2.3.4:65536", "", true},
+		{"1.2.3.4:-1", "", true},
+		{"1.2.3.4:http", "", true},
+		{"1.2.3.256:80", "", true},
+		{"2001:db8::1:80", "", true},
+		{"bad_host:80", "", true},
+		{"-example.com:80", "", true},
+		{":80", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy, func(t *testing.T) {
+			got, err := NormalizeProxy(tt.proxy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 客户端上报的使用结果
+const (
+	OutcomeSuccess   = "success"   // 成功
+	OutcomeBlocked   = "blocked"   // 被目标网站封禁
+	OutcomeCaptcha   = "captcha"   // 出现验证码
+	OutcomeForbidden = "forbidden" // 返回 403
+	OutcomeTimeout   = "timeout"   // 超时
+	OutcomeError     = "error"     // 其它错误
+)
+
+// ValidOutcome 判断使用结果是否合法
+func ValidOutcome(outcome string) bool {
+	switch outcome {
+	case OutcomeSuccess, OutcomeBlocked, OutcomeCaptcha, OutcomeForbidden, OutcomeTimeout, OutcomeError:
+		return true
+	}
+	return false
+}
+
+// Report 客户端上报的一次代理使用记录
+type Report struct {
+	IP      string    `json:"ip"`
+	Host    string    `json:"host"`    // 目标网站
+	Outcome string    `json:"outcome"` // 使用结果
+	Latency int64     `json:"latency"` // 请求耗时(毫秒), 0 表示未知
+	Time    time.Time `json:"time"`
+}
+
+func (pdb *ProxyDB) createReportTable() error {
+	_, err := pdb.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ip TEXT NOT NULL,
+		host TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		latency INTEGER NOT NULL,
+		time INTEGER NOT NULL
+	)`, pdb.table))
+	if err != nil {
+		return err
+	}
+	_, err = pdb.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_reports_ip ON %s_reports (ip, time)", pdb.table, pdb.table))
+	return err
+}
+
+// AddReport 保存一条使用记录
+func (pdb *ProxyDB) AddReport(report *Report) error {
+	_, err := pdb.db.Exec(fmt.Sprintf("INSERT INTO %s_reports (ip, host, outcome, latency, time) VALUES (?, ?, ?, ?, ?)", pdb.table),
+		report.IP, report.Host, report.Outcome, report.Latency, report.Time.Unix())
+	return err
+}
+
+// applyReport 重新读取代理并根据上报结果更新, 上报的耗时计入延迟的滑动平均值.
+// 失败的上报往往只与某个目标网站有关, 只降低质量分并增加失败次数, 不按 MaxFailCount 删除, 质量分低于 MinScore 时才删除
+func applyReport(ip string, report *Report) {
+	modifyProxy(ip, "Report", func(proxy *ProxyItem) bool {
+		if report.Latency > 0 {
+			proxy.Latency = int64(ewma(float64(proxy.Latency), float64(report.Latency)))
+		}
+		if report.Outcome == OutcomeSuccess {
+			return proxySucceeded(proxy, "Report")
+		}
+
+		proxy.UpdateScore(false, scoreHalfLife())
+		proxy.FailCount += 1
+		if app.Config.MinScore > 0 && proxy.Score < float64(app.Config.MinScore) {
+			app.logger.Printf("Report - %s %s, score %.1f delete", proxy.IP, report.Outcome, proxy.Score)
+			return true
+		}
+		app.logger.Printf("Report - %s %s, count %d score %.1f keep", proxy.IP, report.Outcome, proxy.FailCount, proxy.Score)
+		return false
+	})
+}
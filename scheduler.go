@@ -1,40 +1,84 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-co-op/gocron"
 )
 
+// fetching 标记是否有采集任务正在执行, 避免定时任务重叠
+var fetching atomic.Bool
+
 func runProxyFetch() {
-	proxyQueue := make(chan string)
+	if !fetching.CompareAndSwap(false, true) {
+		app.logger.Printf("ProxyFetch - previous fetch still running, skip")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proxyQueue := make(chan Candidate, app.Config.VerifyQueueSize)
 	go func() {
-		app.fetcher.run(app.Config.ProxyFetcher, proxyQueue)
-		for proxy := range proxyQueue {
-			proxyType := app.validator.VerifyProxy(proxy)
-			fmt.Printf("%s proxy type:%0x\n", proxy, proxyType)
-			if proxyType > 0 {
-				if app.Database.Exists(proxy) {
-					app.logger.Printf("RawProxyCheck - %s exist", proxy)
-				} else {
-					app.logger.Printf("RawProxyCheck - %s pass", proxy)
-					region, _ := app.validator.regionGetter(proxy)
-					item := NewProxyItem(proxy, region, proxyType)
-					err := app.Database.Put(item)
-					if err != nil {
-						app.logger.Printf("RawProxyCheck - put %s fail", proxy)
-						return
-					}
-				}
-			} else {
-				app.logger.Printf("RawProxyCheck - %s fail", proxy)
+		if err := app.fetcher.run(ctx, app.sources, proxyQueue); err != nil {
+			app.logger.Printf("ProxyFetch - %s", err)
+		}
+	}()
+	go func() {
+		defer fetching.Store(false)
+		defer cancel()
+		// 同一次采集中重复的代理只验证一次
+		seen := make(map[string]struct{})
+		for candidate := range proxyQueue {
+			proxy := canonicalProxy(candidate.Proxy)
+			if _, ok := seen[proxy]; ok {
+				continue
+			}
+			seen[proxy] = struct{}{}
+			if app.Database.Exists(proxyKey(proxy)) {
+				app.logger.Printf("RawProxyCheck - %s exist", redactProxy(proxy))
+				continue
 			}
+			app.pool.Submit(ctx, proxy, func() {
+				verifyCandidate(proxy)
+			})
 		}
 	}()
 }
 
+// verifyCandidate 验证新采集的代理, 通过后写入数据库
+func verifyCandidate(proxy string) {
+	result := app.validator.VerifyProxy(proxy)
+	fmt.Printf("%s proxy type:%0x\n", redactProxy(proxy), result.Type)
+	item := NewProxyItem(proxy, "", result.Type)
+	if result.Type == 0 {
+		app.logger.Printf("RawProxyCheck - %s fail", item.IP)
+		return
+	}
+	if app.Database.Exists(item.IP) {
+		app.logger.Printf("RawProxyCheck - %s exist", item.IP)
+		return
+	}
+	app.logger.Printf("RawProxyCheck - %s pass", item.IP)
+	item.Apply(result)
+	item.UpdateScore(true, scoreHalfLife())
+	if app.Config.ProxyRegion {
+		geo, err := app.validator.regionGetter(proxy)
+		if err != nil {
+			app.logger.Printf("RawProxyCheck - %s region fail: %s", item.IP, err)
+		} else {
+			item.SetGeo(geo)
+		}
+	}
+	err := app.Database.Put(item)
+	if err != nil {
+		app.logger.Printf("RawProxyCheck - put %s fail", item.IP)
+	}
+	recordChecks(item.IP, result, "RawProxyCheck")
+}
+
 func runProxyCheck() {
 	proxies, err := app.Database.GetAll()
 	if err != nil {
@@ -44,44 +88,129 @@ func runProxyCheck() {
 	if len(proxies) < app.Config.PoolSizeMin {
 		runProxyFetch()
 	}
+	err = app.Database.PruneChecks(time.Duration(app.Config.CheckHistoryDays)*24*time.Hour, app.Config.CheckHistoryMax)
+	if err != nil {
+		app.logger.Printf("UseProxyCheck - prune history fail: %s", err)
+	}
 	for _, proxy := range proxies {
+		ip := proxy.IP
+		app.pool.Submit(context.Background(), ip, func() {
+			checkProxy(ip)
+		})
+	}
+}
+
+// checkProxy 重新验证数据库中的代理, 失败后质量分低于 MinScore 或失败次数超过 MaxFailCount 时删除.
+// 任务可能在排队很久之后才执行, 执行时重新读取代理, 已被删除时跳过,
+// 验证完成后通过 Modify 以最新的数据合并结果, 避免覆盖期间上报、归还或转发代理对失败次数和质量分的修改
+func checkProxy(ip string) {
+	proxy, err := app.Database.GetByIP(ip)
+	if err != nil || proxy == nil {
+		return
+	}
+	result := app.validator.VerifyProxy(proxy.Addr())
+
+	modifyProxy(ip, "UseProxyCheck", func(proxy *ProxyItem) bool {
 		proxy.CheckCount += 1
 		proxy.LastTime = time.Now().Format("2006-01-02 15:04:05")
-		proxyType := app.validator.VerifyProxy(proxy.IP)
-		if proxyType > 0 {
-			proxy.LastStatus = true
-			if proxy.FailCount > 0 {
-				proxy.FailCount -= 1
-			}
-			app.logger.Printf("UseProxyCheck - %s pass", proxy.IP)
-			err := app.Database.Put(proxy)
+		recordChecks(proxy.IP, result, "UseProxyCheck")
+		if result.Type > 0 {
+			proxy.Apply(result)
+			return proxySucceeded(proxy, "UseProxyCheck")
+		}
+		return proxyFailed(proxy, "UseProxyCheck")
+	})
+}
+
+// recordChecks 保存验证记录和各 Profile 的结果, tag 为日志前缀
+func recordChecks(proxy string, result *VerifyResult, tag string) {
+	err := app.Database.AddChecks(proxy, result.Checks)
+	if err != nil {
+		app.logger.Printf("%s - save history %s fail: %s", tag, proxy, err)
+	}
+	err = app.Database.PutProfileResults(proxy, result.Profiles)
+	if err != nil {
+		app.logger.Printf("%s - save profiles %s fail: %s", tag, proxy, err)
+	}
+}
+
+// markProxySucceeded 重新读取代理并记录一次成功, tag 为日志前缀
+func markProxySucceeded(ip, tag string) {
+	modifyProxy(ip, tag, func(proxy *ProxyItem) bool {
+		return proxySucceeded(proxy, tag)
+	})
+}
+
+// markProxyFailed 重新读取代理并记录一次失败, tag 为日志前缀
+func markProxyFailed(ip, tag string) {
+	modifyProxy(ip, tag, func(proxy *ProxyItem) bool {
+		return proxyFailed(proxy, tag)
+	})
+}
+
+// modifyProxy 通过 Modify 修改代理, 失败时记录日志, tag 为日志前缀
+func modifyProxy(ip, tag string, fn func(proxy *ProxyItem) bool) {
+	if err := app.Database.Modify(ip, fn); err != nil {
+		app.logger.Printf("%s - update %s fail: %s", tag, ip, err)
+	}
+}
+
+// proxySucceeded 在 proxy 上记录一次成功, 返回 false 表示保留
+func proxySucceeded(proxy *ProxyItem, tag string) bool {
+	proxy.UpdateScore(true, scoreHalfLife())
+	proxy.LastStatus = true
+	if proxy.FailCount > 0 {
+		proxy.FailCount -= 1
+	}
+	app.logger.Printf("%s - %s pass", tag, proxy.IP)
+	return false
+}
+
+// proxyFailed 在 proxy 上记录一次失败, 质量分低于 MinScore 时返回 true 表示删除;
+// 延迟低、匿名级别高的代理即使一直失败质量分也不会太低, 失败次数超过 MaxFailCount 时同样删除
+func proxyFailed(proxy *ProxyItem, tag string) bool {
+	proxy.UpdateScore(false, scoreHalfLife())
+	proxy.LastStatus = false
+	proxy.FailCount += 1
+	if proxy.Score < float64(app.Config.MinScore) || proxy.FailCount > app.Config.MaxFailCount {
+		app.logger.Printf("%s - %s fail, count %d score %.1f delete", tag, proxy.IP, proxy.FailCount, proxy.Score)
+		return true
+	}
+	app.logger.Printf("%s - %s fail, count %d score %.1f keep", tag, proxy.IP, proxy.FailCount, proxy.Score)
+	return false
+}
+
+// runLocationMigrate 为旧版本只有 Address 的代理补充结构化地理位置,
+// 优先重新查询, 查询失败时解析 Address
+func runLocationMigrate() {
+	proxies, err := app.Database.GetMissingLocation()
+	if err != nil {
+		app.logger.Printf("LocationMigrate - get proxies fail: %s", err)
+		return
+	}
+	for _, proxy := range proxies {
+		var geo *GeoInfo
+		if app.Config.ProxyRegion {
+			geo, err = app.validator.regionGetter(proxy.IP)
 			if err != nil {
-				app.logger.Printf("UseProxyCheck - put %s fail", proxy)
-				return
+				app.logger.Printf("LocationMigrate - %s region fail: %s", proxy.IP, err)
 			}
-		} else {
-			proxy.LastStatus = false
-			proxy.FailCount += 1
-			if proxy.FailCount > app.Config.MaxFailCount {
-				app.logger.Printf("UseProxyCheck - %s fail, count %d delete", proxy.IP, proxy.FailCount)
-				err := app.Database.Delete(proxy.IP)
-				if err != nil {
-					app.logger.Printf("UseProxyCheck - delete %s fail", proxy)
-					return
-				}
-			} else {
-				app.logger.Printf("UseProxyCheck - %s fail, count %d keep", proxy.IP, proxy.FailCount)
-				err := app.Database.Put(proxy)
-				if err != nil {
-					app.logger.Printf("UseProxyCheck - put %s fail", proxy)
-					return
-				}
+		}
+		if geo == nil {
+			if proxy.Address == "" {
+				continue
 			}
+			geo = parseAddress(proxy.Address)
 		}
+		modifyProxy(proxy.IP, "LocationMigrate", func(proxy *ProxyItem) bool {
+			proxy.SetGeo(geo)
+			return false
+		})
 	}
 }
 
 func runScheduler() {
+	go runLocationMigrate()
 	runProxyFetch()
 
 	// 创建调度器对象
@@ -105,3 +234,8 @@ func runScheduler() {
 func testScheduler() {
 	runScheduler()
 }
+
+// scoreHalfLife 质量分中历史结果的半衰期
+func scoreHalfLife() time.Duration {
+	return time.Duration(app.Config.ScoreHalfLife) * time.Second
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// 综合质量分中各项的权重, 合计为 1
+const (
+	scoreWeightReliability = 0.6 // 按时间衰减的成功率
+	scoreWeightLatency     = 0.2 // 延迟
+	scoreWeightAnonymity   = 0.2 // 匿名级别
+)
+
+// anonymityScores 各匿名级别的得分, 未检测时取中间值
+var anonymityScores = map[Anonymity]float64{
+	AnonymityUnknown:     0.5,
+	AnonymityTransparent: 0,
+	AnonymityAnonymous:   0.6,
+	AnonymityElite:       1,
+}
+
+// decayHalfLife 读取和排序时衰减质量分使用的半衰期, 0 表示不衰减
+var decayHalfLife time.Duration
+
+// SetScoreHalfLife 设置读取和排序时衰减质量分使用的半衰期, 与 UpdateScore 的 halfLife 保持一致
+func SetScoreHalfLife(halfLife time.Duration) {
+	decayHalfLife = halfLife
+}
+
+// UpdateScore 记录一次检测、租用或上报的结果并重新计算质量分,
+// 之前的结果按 halfLife 指数衰减, 越近的结果影响越大
+func (p *ProxyItem) UpdateScore(success bool, halfLife time.Duration) {
+	now := time.Now().Unix()
+	p.decay(halfLife, now)
+	if success {
+		p.SuccessWeight += 1
+	}
+	p.TotalWeight += 1
+	p.ScoreTime = now
+	p.Score = p.computeScore()
+}
+
+// decay 将 ScoreTime 之后经过的时间按 halfLife 衰减到历史结果中, 成功率向 0.5 回归, 质量分相应调整.
+// 长时间没有检测的代理不会一直保持很高或很低的质量分
+func (p *ProxyItem) decay(halfLife time.Duration, now int64) {
+	if p.ScoreTime <= 0 || halfLife <= 0 || now <= p.ScoreTime {
+		return
+	}
+	old := p.Reliability()
+	factor := math.Exp2(-float64(now-p.ScoreTime) / halfLife.Seconds())
+	p.SuccessWeight *= factor
+	p.TotalWeight *= factor
+	p.ScoreTime = now
+	score := p.Score + 100*scoreWeightReliability*(p.Reliability()-old)
+	p.Score = math.Round(score*10) / 10
+}
+
+// decayedScore 返回按 decayHalfLife 衰减到当前时间的质量分, 注册为 SQL 函数 decay_score 用于排序和加权选择
+func decayedScore(score, successWeight, totalWeight float64, scoreTime int64) float64 {
+	p := &ProxyItem{Score: score, SuccessWeight: successWeight, TotalWeight: totalWeight, ScoreTime: scoreTime}
+	p.decay(decayHalfLife, time.Now().Unix())
+	return p.Score
+}
+
+// Reliability 按时间衰减后的成功率, 没有记录时为 0.5
+func (p *ProxyItem) Reliability() float64 {
+	return (p.SuccessWeight + 1) / (p.TotalWeight + 2)
+}
+
+// computeScore 计算 0~100 的综合质量分
+func (p *ProxyItem) computeScore() float64 {
+	// 延迟未测量时取中间值, 1s 得 0.5 分, 越快越接近 1
+	latency := 0.5
+	if p.Latency > 0 {
+		latency = 1 / (1 + float64(p.Latency)/1000)
+	}
+	score := scoreWeightReliability*p.Reliability() +
+		scoreWeightLatency*latency +
+		scoreWeightAnonymity*anonymityScores[p.Anonymity]
+	return math.Round(score*1000) / 10
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionStore 保存会话 ID 绑定的代理, 同一会话在有效期内使用同一个代理
+type SessionStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	sessions  map[string]session
+	lastSweep time.Time
+}
+
+type session struct {
+	ip      string
+	expires time.Time
+}
+
+// NewSessionStore 返回 SessionStore 实例, ttl 为会话绑定的有效期
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{
+		ttl:       ttl,
+		sessions:  make(map[string]session),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get 返回会话绑定的代理 ip
+func (s *SessionStore) Get(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || time.Now().After(sess.expires) {
+		return "", false
+	}
+	return sess.ip, true
+}
+
+// Set 将会话绑定到代理 ip, 有效期从此时开始计算
+func (s *SessionStore) Set(id, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sessions[id] = session{ip: ip, expires: now.Add(s.ttl)}
+
+	// 定期清理过期的会话
+	if now.Sub(s.lastSweep) > s.ttl {
+		for key, sess := range s.sessions {
+			if now.After(sess.expires) {
+				delete(s.sessions, key)
+			}
+		}
+		s.lastSweep = now
+	}
+}
+
+// Select 返回会话绑定的代理, 绑定的代理已被删除或不满足 filter 时按 filter 重新选择并绑定
+func (s *SessionStore) Select(db *ProxyDB, id string, filter ProxyFilter) (*ProxyItem, error) {
+	if ip, ok := s.Get(id); ok {
+		pinned := filter
+		pinned.IP = ip
+		proxy, err := db.GetBy(pinned)
+		if err != nil {
+			return nil, err
+		}
+		if proxy != nil {
+			return proxy, nil
+		}
+	}
+
+	proxy, err := db.GetBy(filter)
+	if err != nil || proxy == nil {
+		return nil, err
+	}
+	s.Set(id, proxy.IP)
+	return proxy, nil
+}
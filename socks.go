@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS 协议版本
+const (
+	Socks4  = "socks4"
+	Socks4a = "socks4a"
+	Socks5  = "socks5"
+)
+
+// errTargetFailed 代理已正常应答, 但明确表示无法连接目标地址, 不应计为代理的失败
+var errTargetFailed = errors.New("proxy could not reach target")
+
+// errTargetGateway HTTP 代理返回 502/504, 只有代理最近一次检测正常时才视为目标不可达
+var errTargetGateway = fmt.Errorf("proxy gateway error: %w", errTargetFailed)
+
+// socks5TargetErrors 明确表示目标不可达的 SOCKS5 应答码,
+// 0x01 通用错误和 0x02 规则禁止无法区分是代理故障还是目标的问题, 按代理失败处理
+var socks5TargetErrors = map[byte]bool{0x03: true, 0x04: true, 0x05: true, 0x06: true, 0x08: true}
+
+var socks5Errors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SocksDialer 通过 SOCKS4/SOCKS4a/SOCKS5 代理建立 TCP 连接
+type SocksDialer struct {
+	Version  string // socks4, socks4a 或 socks5
+	Addr     string // 代理地址 host:port
+	Username string // SOCKS5 用户名, SOCKS4 中作为 userid
+	Password string // SOCKS5 密码
+}
+
+// NewSocksDialer 返回 SocksDialer 实例, proxy 格式为 [user:pass@]host:port
+func NewSocksDialer(version, proxy string) *SocksDialer {
+	username, password, addr := splitProxyAuth(proxy)
+	return &SocksDialer{
+		Version:  version,
+		Addr:     addr,
+		Username: username,
+		Password: password,
+	}
+}
+
+// DialContext 连接代理并完成握手, 返回的连接已经连通到 addr
+func (d *SocksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("%s: network %s not supported", d.Version, network)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	switch d.Version {
+	case Socks5:
+		err = d.handshake5(conn, addr)
+	case Socks4, Socks4a:
+		err = d.handshake4(ctx, conn, addr)
+	default:
+		err = fmt.Errorf("unknown socks version %s", d.Version)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *SocksDialer) handshake5(conn net.Conn, addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	// 协商认证方式
+	methods := []byte{0x00}
+	if d.Username != "" {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("socks5: unexpected version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if d.Username == "" {
+			return errors.New("socks5: server requires authentication")
+		}
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		req := []byte{0x01, byte(len(d.Username))}
+		req = append(req, d.Username...)
+		req = append(req, byte(len(d.Password)))
+		req = append(req, d.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: username/password authentication failed")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication methods")
+	}
+
+	// 发送 CONNECT 请求
+	req := []byte{0x05, 0x01, 0x00}
+	req = appendSocks5Addr(req, host, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 0x05 {
+		return fmt.Errorf("socks5: unexpected version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		if msg, ok := socks5Errors[header[1]]; ok {
+			if socks5TargetErrors[header[1]] {
+				return fmt.Errorf("socks5: %s: %w", msg, errTargetFailed)
+			}
+			return errors.New("socks5: " + msg)
+		}
+		return fmt.Errorf("socks5: unknown reply code %d", header[1])
+	}
+	// 跳过绑定地址
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+func (d *SocksDialer) handshake4(ctx context.Context, conn net.Conn, addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	req := []byte{0x04, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+	ip := net.ParseIP(host).To4()
+	remoteResolve := false
+	if ip == nil {
+		if d.Version == Socks4a {
+			// SOCKS4a 使用 0.0.0.x 表示由代理解析域名
+			ip = net.IPv4(0, 0, 0, 1).To4()
+			remoteResolve = true
+		} else {
+			addrs, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+			if err != nil {
+				return fmt.Errorf("socks4: %s: %w", err, errTargetFailed)
+			}
+			if len(addrs) == 0 {
+				return fmt.Errorf("socks4: no IPv4 address for %s: %w", host, errTargetFailed)
+			}
+			ip = addrs[0].To4()
+		}
+	}
+	req = append(req, ip...)
+	req = append(req, d.Username...)
+	req = append(req, 0)
+	if remoteResolve {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x00 {
+		return fmt.Errorf("%s: unexpected reply version %d", d.Version, reply[0])
+	}
+	if reply[1] != 0x5a {
+		// 0x5b 同时表示请求被拒绝和连接目标失败, 无法区分, 按代理失败处理
+		return fmt.Errorf("%s: request rejected, code %#x", d.Version, reply[1])
+	}
+	return nil
+}
+
+// appendSocks5Addr 按 SOCKS5 地址格式追加 host 和 port
+func appendSocks5Addr(b []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, 0x01)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, 0x04)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		b = append(b, 0x03, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, port)
+}
+
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %s", portStr)
+	}
+	if len(host) > 255 {
+		return "", 0, errors.New("host name too long")
+	}
+	return host, uint16(port), nil
+}
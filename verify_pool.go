@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// VerifyPool 有界的代理验证协程池, 同一代理同时只会有一个任务在排队或执行
+type VerifyPool struct {
+	tasks    chan verifyTask
+	mu       sync.Mutex
+	inflight map[string]struct{}
+}
+
+type verifyTask struct {
+	key string
+	fn  func()
+}
+
+// NewVerifyPool 返回 VerifyPool 实例并启动 workers 个验证协程, queueSize 为等待队列长度
+func NewVerifyPool(workers, queueSize int) *VerifyPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p := &VerifyPool{
+		tasks:    make(chan verifyTask, queueSize),
+		inflight: make(map[string]struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *VerifyPool) worker() {
+	for task := range p.tasks {
+		task.fn()
+		p.mu.Lock()
+		delete(p.inflight, task.key)
+		p.mu.Unlock()
+	}
+}
+
+// Submit 提交验证任务, 队列已满时阻塞直到有空位或 ctx 取消;
+// key 相同的任务正在排队或执行时直接忽略, 未提交时返回 false
+func (p *VerifyPool) Submit(ctx context.Context, key string, fn func()) bool {
+	p.mu.Lock()
+	if _, ok := p.inflight[key]; ok {
+		p.mu.Unlock()
+		return false
+	}
+	p.inflight[key] = struct{}{}
+	p.mu.Unlock()
+
+	select {
+	case p.tasks <- verifyTask{key: key, fn: fn}:
+		return true
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.inflight, key)
+		p.mu.Unlock()
+		return false
+	}
+}
+
+// Pending 返回正在排队或执行的任务数
+func (p *VerifyPool) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.inflight)
+}